@@ -0,0 +1,70 @@
+import { fetchWithRetry, RetryPolicy } from "./http";
+import { logInfo } from "./newRelic";
+import { SensorResults } from "./purpleAir";
+import {
+  NoResultsError,
+  SensorSource,
+  UpstreamStatusError,
+} from "./source";
+import { userAgent } from "./version";
+
+export type AirNowConfig = {
+  apiKey: string;
+  latitude: number;
+  longitude: number;
+  distance: number; // miles
+  retry: RetryPolicy;
+};
+
+// AirNowSource reports the official AQI for the nearest AirNow reporting area.
+// observations are hourly, so there is no separate real-time reading.
+export class AirNowSource implements SensorSource {
+  constructor(private config: AirNowConfig) {}
+
+  async readings(): Promise<SensorResults> {
+    const params = new URLSearchParams({
+      format: "application/json",
+      latitude: String(this.config.latitude),
+      longitude: String(this.config.longitude),
+      distance: String(this.config.distance),
+      API_KEY: this.config.apiKey,
+    });
+    let response = await fetchWithRetry(
+      `https://www.airnowapi.org/aq/observation/latLong/current/?${params}`,
+      { headers: { "user-agent": userAgent() } },
+      this.config.retry
+    );
+    if (!response.ok) {
+      throw new UpstreamStatusError(
+        `non-ok status code returned from airnow (${response.statusText})`,
+        response.status
+      );
+    }
+    let observations = (await response.json()) as Observation[];
+    if (observations.length === 0) {
+      throw new NoResultsError(
+        "airnow returned no observations for this location"
+      );
+    }
+    // the reported AQI is the highest of each pollutant's AQI
+    let aqi = -1;
+    for (let o of observations) {
+      aqi = Math.max(aqi, o.AQI);
+    }
+    logInfo("airnow observations", {
+      reportingArea: observations[0].ReportingArea,
+      observations: observations.map((o) => `${o.ParameterName}=${o.AQI}`),
+    });
+    return {
+      realtime: aqi,
+      tenMinuteAvg: aqi,
+      sensorID: observations[0].ReportingArea,
+    };
+  }
+}
+
+export interface Observation {
+  ReportingArea: string;
+  ParameterName: string;
+  AQI: number;
+}
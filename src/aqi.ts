@@ -0,0 +1,514 @@
+// AirQualityIndex is a scale that PM concentrations are reported on, split
+// into named categories.
+export interface AirQualityIndex {
+  name: string; // what values are labelled as, e.g. "AQI"
+  defaultThreshold: number; // used when AQ_THRESHOLD is not set
+  categories: string[]; // best first
+  fromPM(pm: number): number; // PM2.5 (µg/m³)
+  fromPM10?(pm: number): number; // PM10 (µg/m³), if the index accounts for it
+  category(value: number): string;
+  // the highest value that is still better than the category
+  floor(category: string): number;
+}
+
+// roundAQI rounds an index value to precision decimal places (AQI_PRECISION),
+// for reporting it. categories are told by the whole number either way.
+export function roundAQI(value: number, precision: number): number {
+  const pow10 = Math.pow(10, precision);
+  return Math.round(value * pow10) / pow10;
+}
+
+// roundReadings is readings with both index values rounded by roundAQI.
+export function roundReadings<
+  T extends { realtime: number; tenMinuteAvg: number }
+>(readings: T, precision: number): T {
+  return {
+    ...readings,
+    realtime: roundAQI(readings.realtime, precision),
+    tenMinuteAvg: roundAQI(readings.tenMinuteAvg, precision),
+  };
+}
+
+export enum AQICategory {
+  Good = "Good",
+  Moderate = "Moderate",
+  UnhealthySensitive = "Unhealthy for Sensitive Groups",
+  Unhealthy = "Unhealthy",
+  VeryUnhealthy = "Very Unhealthy",
+  Hazardous = "Hazardous",
+}
+
+export function categoryFromAQI(aqi: number): AQICategory {
+  aqi = Math.round(aqi);
+  if (aqi <= 50) {
+    return AQICategory.Good;
+  } else if (aqi <= 100) {
+    return AQICategory.Moderate;
+  } else if (aqi <= 150) {
+    return AQICategory.UnhealthySensitive;
+  } else if (aqi <= 200) {
+    return AQICategory.Unhealthy;
+  } else if (aqi <= 300) {
+    return AQICategory.VeryUnhealthy;
+  }
+  return AQICategory.Hazardous;
+}
+
+const CATEGORY_ORDER: string[] = [
+  AQICategory.Good,
+  AQICategory.Moderate,
+  AQICategory.UnhealthySensitive,
+  AQICategory.Unhealthy,
+  AQICategory.VeryUnhealthy,
+  AQICategory.Hazardous,
+];
+
+// the highest AQI that is still better than each category
+const CATEGORY_FLOORS: Record<AQICategory, number> = {
+  [AQICategory.Good]: -1,
+  [AQICategory.Moderate]: 50,
+  [AQICategory.UnhealthySensitive]: 100,
+  [AQICategory.Unhealthy]: 150,
+  [AQICategory.VeryUnhealthy]: 200,
+  [AQICategory.Hazardous]: 300,
+};
+
+// US_AQI is the US EPA's Air Quality Index.
+export const US_AQI: AirQualityIndex = {
+  name: "AQI",
+  defaultThreshold: 65,
+  categories: CATEGORY_ORDER,
+  fromPM: aqiFromPM,
+  fromPM10: aqiFromPM10,
+  category: categoryFromAQI,
+  floor: (category) => CATEGORY_FLOORS[category as AQICategory] ?? NaN,
+};
+
+export enum AQHICategory {
+  Low = "Low Risk",
+  Moderate = "Moderate Risk",
+  High = "High Risk",
+  VeryHigh = "Very High Risk",
+}
+
+const AQHI_FLOORS: Record<AQHICategory, number> = {
+  [AQHICategory.Low]: -1,
+  [AQHICategory.Moderate]: 3,
+  [AQHICategory.High]: 6,
+  [AQHICategory.VeryHigh]: 10,
+};
+
+export function categoryFromAQHI(aqhi: number): AQHICategory {
+  if (aqhi <= 3) {
+    return AQHICategory.Low;
+  } else if (aqhi <= 6) {
+    return AQHICategory.Moderate;
+  } else if (aqhi <= 10) {
+    return AQHICategory.High;
+  }
+  return AQHICategory.VeryHigh;
+}
+
+// aqhi is Canada's Air Quality Health Index. the full formula takes 3 hour
+// averages of O3 and NO2 (ppb) along with PM2.5 (µg/m³). without them it is
+// AQHI+, 1 point per 10 µg/m³ of PM2.5, which is what the provinces use for
+// wildfire smoke.
+export function aqhi(c: { pm25: number; o3?: number; no2?: number }): number {
+  if (isNaN(c.pm25) || c.pm25 > 1000) {
+    return NaN;
+  }
+  if (c.o3 === undefined || c.no2 === undefined) {
+    return Math.max(1, Math.ceil(c.pm25 / 10));
+  }
+  const risk =
+    Math.exp(0.000871 * c.no2) -
+    1 +
+    (Math.exp(0.000537 * c.o3) - 1) +
+    (Math.exp(0.000487 * c.pm25) - 1);
+  return Math.max(1, Math.round((1000 / 10.4) * risk));
+}
+
+export const AQHI: AirQualityIndex = {
+  name: "AQHI",
+  defaultThreshold: 3,
+  categories: Object.values(AQHICategory),
+  fromPM: (pm25) => aqhi({ pm25 }),
+  category: categoryFromAQHI,
+  floor: (category) => AQHI_FLOORS[category as AQHICategory] ?? NaN,
+};
+
+export enum CPCBCategory {
+  Good = "Good",
+  Satisfactory = "Satisfactory",
+  ModeratelyPolluted = "Moderately Polluted",
+  Poor = "Poor",
+  VeryPoor = "Very Poor",
+  Severe = "Severe",
+}
+
+const CPCB_FLOORS: Record<CPCBCategory, number> = {
+  [CPCBCategory.Good]: -1,
+  [CPCBCategory.Satisfactory]: 50,
+  [CPCBCategory.ModeratelyPolluted]: 100,
+  [CPCBCategory.Poor]: 200,
+  [CPCBCategory.VeryPoor]: 300,
+  [CPCBCategory.Severe]: 400,
+};
+
+export function categoryFromCPCB(aqi: number): CPCBCategory {
+  aqi = Math.round(aqi);
+  if (aqi <= 50) {
+    return CPCBCategory.Good;
+  } else if (aqi <= 100) {
+    return CPCBCategory.Satisfactory;
+  } else if (aqi <= 200) {
+    return CPCBCategory.ModeratelyPolluted;
+  } else if (aqi <= 300) {
+    return CPCBCategory.Poor;
+  } else if (aqi <= 400) {
+    return CPCBCategory.VeryPoor;
+  }
+  return CPCBCategory.Severe;
+}
+
+export function cpcbFromPM(pm: number): number {
+  if (isNaN(pm) || pm < 0 || pm > 1000) {
+    return NaN;
+  }
+  /*
+    Good                 0 - 50      0 - 30
+    Satisfactory         51 - 100    31 - 60
+    Moderately Polluted  101 - 200   61 - 90
+    Poor                 201 - 300   91 - 120
+    Very Poor            301 - 400   121 - 250
+    Severe               401 - 500   251 - 380
+
+    the bands are interpolated from the upper bound of the one below (e.g.
+    30 - 60 for 50 - 100), so that readings in between (e.g. 30.5) carry on
+    from the band below instead of falling in a gap
+  */
+  if (pm > 250) {
+    return calcAQI(pm, 500, 400, 380, 250);
+  } else if (pm > 120) {
+    return calcAQI(pm, 400, 300, 250, 120);
+  } else if (pm > 90) {
+    return calcAQI(pm, 300, 200, 120, 90);
+  } else if (pm > 60) {
+    return calcAQI(pm, 200, 100, 90, 60);
+  } else if (pm > 30) {
+    return calcAQI(pm, 100, 50, 60, 30);
+  }
+  return calcAQI(pm, 50, 0, 30, 0);
+}
+
+export function cpcbFromPM10(pm: number): number {
+  if (isNaN(pm) || pm < 0 || pm > 1000) {
+    return NaN;
+  }
+  /*
+    Good                 0 - 50      0 - 50
+    Satisfactory         51 - 100    51 - 100
+    Moderately Polluted  101 - 200   101 - 250
+    Poor                 201 - 300   251 - 350
+    Very Poor            301 - 400   351 - 430
+    Severe               401 - 500   431 - 510
+
+    interpolated from the band below's upper bound, like cpcbFromPM
+  */
+  if (pm > 430) {
+    return calcAQI(pm, 500, 400, 510, 430);
+  } else if (pm > 350) {
+    return calcAQI(pm, 400, 300, 430, 350);
+  } else if (pm > 250) {
+    return calcAQI(pm, 300, 200, 350, 250);
+  } else if (pm > 100) {
+    return calcAQI(pm, 200, 100, 250, 100);
+  } else if (pm > 50) {
+    return calcAQI(pm, 100, 50, 100, 50);
+  }
+  return calcAQI(pm, 50, 0, 50, 0);
+}
+
+// CPCB is India's National Air Quality Index, from the Central Pollution
+// Control Board.
+export const CPCB: AirQualityIndex = {
+  name: "CPCB AQI",
+  defaultThreshold: 100,
+  categories: Object.values(CPCBCategory),
+  fromPM: cpcbFromPM,
+  fromPM10: cpcbFromPM10,
+  category: categoryFromCPCB,
+  floor: (category) => CPCB_FLOORS[category as CPCBCategory] ?? NaN,
+};
+
+export enum CAQICategory {
+  VeryLow = "Very Low",
+  Low = "Low",
+  Medium = "Medium",
+  High = "High",
+  VeryHigh = "Very High",
+}
+
+const CAQI_FLOORS: Record<CAQICategory, number> = {
+  [CAQICategory.VeryLow]: -1,
+  [CAQICategory.Low]: 25,
+  [CAQICategory.Medium]: 50,
+  [CAQICategory.High]: 75,
+  [CAQICategory.VeryHigh]: 100,
+};
+
+export function categoryFromCAQI(caqi: number): CAQICategory {
+  caqi = Math.round(caqi);
+  if (caqi <= 25) {
+    return CAQICategory.VeryLow;
+  } else if (caqi <= 50) {
+    return CAQICategory.Low;
+  } else if (caqi <= 75) {
+    return CAQICategory.Medium;
+  } else if (caqi <= 100) {
+    return CAQICategory.High;
+  }
+  return CAQICategory.VeryHigh;
+}
+
+// the CAQI has no upper bound, values past 100 carry on at the same rate as
+// the High band.
+export function caqiFromPM(pm: number): number {
+  if (isNaN(pm) || pm < 0 || pm > 1000) {
+    return NaN;
+  }
+  /*
+    Very Low   0 - 25     0 - 15
+    Low        25 - 50    15 - 30
+    Medium     50 - 75    30 - 55
+    High       75 - 100   55 - 110
+    Very High  > 100      > 110
+  */
+  if (pm > 55) {
+    return calcAQI(pm, 100, 75, 110, 55);
+  } else if (pm > 30) {
+    return calcAQI(pm, 75, 50, 55, 30);
+  } else if (pm > 15) {
+    return calcAQI(pm, 50, 25, 30, 15);
+  }
+  return calcAQI(pm, 25, 0, 15, 0);
+}
+
+export function caqiFromPM10(pm: number): number {
+  if (isNaN(pm) || pm < 0 || pm > 1000) {
+    return NaN;
+  }
+  /*
+    Very Low   0 - 25     0 - 25
+    Low        25 - 50    25 - 50
+    Medium     50 - 75    50 - 90
+    High       75 - 100   90 - 180
+    Very High  > 100      > 180
+  */
+  if (pm > 90) {
+    return calcAQI(pm, 100, 75, 180, 90);
+  } else if (pm > 50) {
+    return calcAQI(pm, 75, 50, 90, 50);
+  }
+  return calcAQI(pm, 50, 0, 50, 0);
+}
+
+// CAQI is the EU's Common Air Quality Index, with the hourly (roadside and
+// background alike) PM grid.
+export const CAQI: AirQualityIndex = {
+  name: "CAQI",
+  defaultThreshold: 50,
+  categories: Object.values(CAQICategory),
+  fromPM: caqiFromPM,
+  fromPM10: caqiFromPM10,
+  category: categoryFromCAQI,
+  floor: (category) => CAQI_FLOORS[category as CAQICategory] ?? NaN,
+};
+
+export const INDICES: Record<string, AirQualityIndex> = {
+  aqi: US_AQI,
+  aqhi: AQHI,
+  cpcb: CPCB,
+  caqi: CAQI,
+};
+
+// findCategory parses a category name (e.g. "unhealthy", "very unhealthy" or
+// "usg") into one of the index's categories, or returns undefined if it isn't
+// one of them.
+export function findCategory(
+  index: AirQualityIndex,
+  name: string
+): string | undefined {
+  // "risk" is left off, so that AQHI categories can be given as e.g. "high"
+  const normalize = (s: string) =>
+    s
+      .toLowerCase()
+      .replace(/[^a-z]/g, "")
+      .replace(/risk$/, "");
+  const wanted = normalize(name);
+  if (
+    wanted === "usg" &&
+    index.categories.includes(AQICategory.UnhealthySensitive)
+  ) {
+    return AQICategory.UnhealthySensitive;
+  }
+  return index.categories.find((category) => normalize(category) === wanted);
+}
+
+// compareCategories is negative when a is better than b, and positive when a
+// is worse than b.
+export function compareCategories(
+  index: AirQualityIndex,
+  a: string,
+  b: string
+): number {
+  return index.categories.indexOf(a) - index.categories.indexOf(b);
+}
+
+// AQIBreakpoint is a row of the EPA's table of PM2.5 concentrations (µg/m³,
+// 24 hour average) against AQI values.
+export type AQIBreakpoint = {
+  category: AQICategory;
+  aqi: [number, number];
+  pm25: [number, number];
+};
+
+// worst first, hazardous takes up two rows
+export const AQI_PM25_BREAKPOINTS: AQIBreakpoint[] = [
+  { category: AQICategory.Hazardous, aqi: [401, 500], pm25: [350.5, 500] },
+  { category: AQICategory.Hazardous, aqi: [301, 400], pm25: [250.5, 350.4] },
+  {
+    category: AQICategory.VeryUnhealthy,
+    aqi: [201, 300],
+    pm25: [150.5, 250.4],
+  },
+  { category: AQICategory.Unhealthy, aqi: [151, 200], pm25: [55.5, 150.4] },
+  {
+    category: AQICategory.UnhealthySensitive,
+    aqi: [101, 150],
+    pm25: [35.5, 55.4],
+  },
+  { category: AQICategory.Moderate, aqi: [51, 100], pm25: [12.1, 35.4] },
+  { category: AQICategory.Good, aqi: [0, 50], pm25: [0, 12] },
+];
+
+// aqiCategories lists each AQI category (best first) with the range of AQI
+// values and PM2.5 concentrations it spans.
+export function aqiCategories(): AQIBreakpoint[] {
+  const merged: AQIBreakpoint[] = [];
+  for (let bp of [...AQI_PM25_BREAKPOINTS].reverse()) {
+    const last = merged[merged.length - 1];
+    if (last?.category === bp.category) {
+      last.aqi = [last.aqi[0], bp.aqi[1]];
+      last.pm25 = [last.pm25[0], bp.pm25[1]];
+    } else {
+      merged.push({ ...bp, aqi: [...bp.aqi], pm25: [...bp.pm25] });
+    }
+  }
+  return merged;
+}
+
+export function aqiFromPM(pm: number): number {
+  if (isNaN(pm)) {
+    return NaN;
+  }
+  if (pm < 0) {
+    return pm;
+  }
+  if (pm > 1000) {
+    return NaN;
+  }
+  for (let { aqi, pm25 } of AQI_PM25_BREAKPOINTS) {
+    // the good row starts at 0 itself, the others just past their start
+    if (pm > pm25[0] || pm25[0] === 0) {
+      return calcAQI(pm, aqi[1], aqi[0], pm25[1], pm25[0]);
+    }
+  }
+  return NaN;
+}
+
+function calcAQI(
+  Cp: number,
+  Ih: number,
+  Il: number,
+  BPh: number,
+  BPl: number
+): number {
+  const a = Ih - Il;
+  const b = BPh - BPl;
+  const c = Cp - BPl;
+  return (a / b) * c + Il;
+}
+
+export function aqiFromPM10(pm: number): number {
+  if (isNaN(pm) || pm < 0 || pm > 604) {
+    return NaN;
+  }
+  /*
+    Good                            0 - 50      0 - 54
+    Moderate                        51 - 100    55 - 154
+    Unhealthy for Sensitive Groups  101 - 150   155 - 254
+    Unhealthy                       151 - 200   255 - 354
+    Very Unhealthy                  201 - 300   355 - 424
+    Hazardous                       301 - 400   425 - 504
+    Hazardous                       401 - 500   505 - 604
+  */
+  if (pm > 504) {
+    return calcAQI(pm, 500, 401, 604, 505);
+  } else if (pm > 424) {
+    return calcAQI(pm, 400, 301, 504, 425);
+  } else if (pm > 354) {
+    return calcAQI(pm, 300, 201, 424, 355);
+  } else if (pm > 254) {
+    return calcAQI(pm, 200, 151, 354, 255);
+  } else if (pm > 154) {
+    return calcAQI(pm, 150, 101, 254, 155);
+  } else if (pm > 54) {
+    return calcAQI(pm, 100, 51, 154, 55);
+  }
+  return calcAQI(pm, 50, 0, 54, 0);
+}
+
+// nowCast is the EPA's NowCast for particulates: a weighted average of up to
+// 12 hourly concentrations (most recent first, NaN for missing hours), that
+// leans on recent hours more the more the air has been changing. it is NaN
+// unless at least 2 of the 3 most recent hours are available.
+export function nowCast(hourly: number[]): number {
+  const hours = hourly.slice(0, 12);
+  if (hours.slice(0, 3).filter((c) => !isNaN(c)).length < 2) {
+    return NaN;
+  }
+  const known = hours.filter((c) => !isNaN(c));
+  const min = Math.min(...known);
+  const max = Math.max(...known);
+  const weight = max === 0 ? 1 : Math.max(min / max, 0.5);
+  let total = 0;
+  let weights = 0;
+  for (let [i, c] of hours.entries()) {
+    if (isNaN(c)) {
+      continue;
+    }
+    total += Math.pow(weight, i) * c;
+    weights += Math.pow(weight, i);
+  }
+  return total / weights;
+}
+
+export type Pollutant = "pm2.5" | "pm10";
+
+// overallAQI is the highest of the per pollutant AQIs, which is how the EPA
+// defines the reported AQI.
+export function overallAQI(
+  aqis: Partial<Record<Pollutant, number>>
+): { aqi: number; dominant: Pollutant } {
+  let result = { aqi: NaN, dominant: "pm2.5" as Pollutant };
+  for (let [pollutant, aqi] of Object.entries(aqis) as [Pollutant, number][]) {
+    if (isNaN(aqi)) {
+      continue;
+    }
+    if (isNaN(result.aqi) || aqi > result.aqi) {
+      result = { aqi, dominant: pollutant };
+    }
+  }
+  return result;
+}
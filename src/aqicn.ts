@@ -0,0 +1,99 @@
+import { Pollutant } from "./aqi";
+import { fetchWithRetry, RetryPolicy } from "./http";
+import { logInfo } from "./newRelic";
+import { SensorResults } from "./purpleAir";
+import {
+  NoResultsError,
+  SensorSource,
+  StaleDataError,
+  UpstreamStatusError,
+} from "./source";
+import { userAgent } from "./version";
+
+export type AQICNConfig = {
+  token: string;
+  // either a station id (as in https://aqicn.org/station/@1451), or else the
+  // coordinates to use the nearest station to
+  station?: string;
+  latitude?: number;
+  longitude?: number;
+  retry: RetryPolicy;
+};
+
+// stations update hourly, so this gives one a couple of missed updates
+const MAX_AGE = 1000 * 60 * 60 * 3; // 3 hours
+
+// AQICNSource reports the AQI of a station of the World Air Quality Index
+// project (https://waqi.info), which covers a lot of places PurpleAir doesn't.
+// like AirNow, it is the reported AQI (on the US EPA scale), with no separate
+// real-time reading.
+export class AQICNSource implements SensorSource {
+  constructor(private config: AQICNConfig) {}
+
+  async readings(): Promise<SensorResults> {
+    const feed = this.config.station
+      ? `@${encodeURIComponent(this.config.station)}`
+      : `geo:${this.config.latitude};${this.config.longitude}`;
+    const params = new URLSearchParams({ token: this.config.token });
+    let response = await fetchWithRetry(
+      `https://api.waqi.info/feed/${feed}/?${params}`,
+      { headers: { "user-agent": userAgent() } },
+      this.config.retry
+    );
+    if (!response.ok) {
+      throw new UpstreamStatusError(
+        `non-ok status code returned from aqicn (${response.statusText})`,
+        response.status
+      );
+    }
+    const body = (await response.json()) as AQICNResponse;
+    // errors (e.g. an invalid token) come back with a 200 too
+    if (body.status !== "ok" || typeof body.data !== "object") {
+      throw new Error(`aqicn returned an error: ${body.data}`);
+    }
+    const data = body.data;
+    if (typeof data.aqi !== "number") {
+      throw new NoResultsError(
+        `aqicn station ${data.idx} has no AQI reading right now`
+      );
+    }
+    const observed = Date.parse(data.time?.iso || "");
+    if (isNaN(observed) || Date.now() - observed > MAX_AGE) {
+      throw new StaleDataError(
+        `aqicn station ${data.idx} was last updated at ${data.time?.iso}`
+      );
+    }
+    logInfo("aqicn station", {
+      station: data.idx,
+      city: data.city?.name,
+      dominant: data.dominentpol,
+      observed: data.time?.iso,
+    });
+    return {
+      realtime: data.aqi,
+      tenMinuteAvg: data.aqi,
+      sensorID: String(data.idx),
+      dominantPollutant: DOMINANT_POLLUTANTS[data.dominentpol || ""],
+    };
+  }
+}
+
+// aqicn's names for the pollutants that are ours too
+const DOMINANT_POLLUTANTS: Record<string, Pollutant> = {
+  pm25: "pm2.5",
+  pm10: "pm10",
+};
+
+// https://aqicn.org/json-api/doc/
+interface AQICNResponse {
+  status: string;
+  data: string | AQICNData; // an error message, unless status is "ok"
+}
+
+interface AQICNData {
+  aqi: number | string; // "-" when there is no reading
+  idx: number;
+  city?: { name?: string };
+  dominentpol?: string; // sic
+  time?: { iso?: string };
+}
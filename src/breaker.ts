@@ -0,0 +1,67 @@
+import { logInfo, logWarn } from "./newRelic";
+
+export type BreakerConfig = {
+  threshold: number; // consecutive failures before opening, 0 disables it
+  backoff: number; // milliseconds, doubled each time it re-opens
+};
+
+export type BreakerState = {
+  failures: number; // consecutive
+  trips: number; // times opened since it last closed
+  openUntil?: number; // unix epoch (milliseconds)
+};
+
+export type BreakerStatus = "closed" | "open" | "half-open";
+
+// state is kept in kv with a 1 hour expiry that isn't refreshed while the
+// breaker is open, so it can't stay open for longer than this.
+const MAX_BACKOFF = 1000 * 60 * 30;
+
+// while open, the breaker skips fetching entirely. once the backoff is over it
+// is half-open: the next fetch either closes it again or re-opens it for
+// twice as long.
+export function breakerStatus(
+  breaker: BreakerState | undefined,
+  now: number
+): BreakerStatus {
+  if (!breaker || breaker.openUntil === undefined) {
+    return "closed";
+  }
+  return now < breaker.openUntil ? "open" : "half-open";
+}
+
+export function breakerFailure(
+  breaker: BreakerState | undefined,
+  config: BreakerConfig,
+  now: number
+): BreakerState | undefined {
+  if (config.threshold <= 0) {
+    return undefined;
+  }
+  const failures = (breaker?.failures || 0) + 1;
+  const status = breakerStatus(breaker, now);
+  if (status === "closed" && failures < config.threshold) {
+    return { failures, trips: 0 };
+  }
+  const trips = status === "closed" ? 1 : (breaker?.trips || 0) + 1;
+  const backoff = Math.min(
+    MAX_BACKOFF,
+    config.backoff * Math.pow(2, trips - 1)
+  );
+  logWarn(
+    status === "closed"
+      ? "circuit breaker opened"
+      : "circuit breaker re-opened",
+    { failures, backoff }
+  );
+  return { failures, trips, openUntil: now + backoff };
+}
+
+// breakerSuccess returns the state of the breaker after a successful fetch,
+// which is always closed with no failures.
+export function breakerSuccess(breaker: BreakerState | undefined): undefined {
+  if (breaker?.openUntil !== undefined) {
+    logInfo("circuit breaker closed");
+  }
+  return undefined;
+}
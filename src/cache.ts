@@ -0,0 +1,110 @@
+import { logInfo, logWarn } from "./newRelic";
+
+type Entry = { body: string; expires: number };
+
+// per isolate, so it only helps with requests that land on the same one. the
+// cache api is shared by everything in the colo, but is a no-op on workers.dev
+const memory = new Map<string, Entry>();
+
+const EXPIRES_HEADER = "x-aqimon-expires"; // unix epoch (milliseconds)
+
+// cachedFetch returns a cached copy of the response for key while it is
+// fresh, and otherwise calls fetcher and caches what it returns (if ok) for
+// ttl milliseconds, or less if the response's cache-control says so.
+export async function cachedFetch(
+  key: string,
+  ttl: number,
+  fetcher: () => Promise<Response>
+): Promise<Response> {
+  if (ttl <= 0) {
+    return fetcher();
+  }
+  const hit = memory.get(key) || (await sharedGet(key));
+  if (hit && hit.expires > Date.now()) {
+    logInfo("using cached response", {
+      key,
+      expires: new Date(hit.expires),
+    });
+    memory.set(key, hit);
+    return new Response(hit.body);
+  }
+  const response = await fetcher();
+  ttl = Math.min(ttl, providerTTL(response));
+  if (!response.ok || ttl <= 0) {
+    return response;
+  }
+  const entry = { body: await response.text(), expires: Date.now() + ttl };
+  memory.set(key, entry);
+  await sharedPut(key, entry);
+  return new Response(entry.body, {
+    status: response.status,
+    headers: response.headers,
+  });
+}
+
+// providerTTL is how much longer (in milliseconds) the response says it may
+// be cached for, going by its cache-control and age headers.
+function providerTTL(response: Response): number {
+  const cacheControl = (response.headers.get("cache-control") || "")
+    .toLowerCase()
+    .split(",")
+    .map((s) => s.trim());
+  if (cacheControl.includes("no-store") || cacheControl.includes("no-cache")) {
+    return 0;
+  }
+  const maxAge = cacheControl.find((d) => d.startsWith("max-age="));
+  if (!maxAge) {
+    return Infinity;
+  }
+  const seconds = Number(maxAge.slice("max-age=".length));
+  const age = Number(response.headers.get("age") || 0);
+  if (isNaN(seconds) || isNaN(age)) {
+    return Infinity;
+  }
+  return Math.max(0, seconds - age) * 1000;
+}
+
+function cacheRequest(key: string): Request {
+  return new Request(
+    `https://cache.aqimon.invalid/?key=${encodeURIComponent(key)}`
+  );
+}
+
+async function sharedGet(key: string): Promise<Entry | undefined> {
+  if (typeof caches === "undefined") {
+    return undefined;
+  }
+  try {
+    const response = await caches.default.match(cacheRequest(key));
+    if (!response) {
+      return undefined;
+    }
+    return {
+      body: await response.text(),
+      expires: Number(response.headers.get(EXPIRES_HEADER)),
+    };
+  } catch (e) {
+    logWarn("failed to read from the cache", { key, error: e.message });
+    return undefined;
+  }
+}
+
+async function sharedPut(key: string, entry: Entry): Promise<void> {
+  if (typeof caches === "undefined") {
+    return;
+  }
+  const ttl = Math.ceil((entry.expires - Date.now()) / 1000);
+  try {
+    await caches.default.put(
+      cacheRequest(key),
+      new Response(entry.body, {
+        headers: {
+          "cache-control": `max-age=${ttl}`,
+          [EXPIRES_HEADER]: String(entry.expires),
+        },
+      })
+    );
+  } catch (e) {
+    logWarn("failed to write to the cache", { key, error: e.message });
+  }
+}
@@ -0,0 +1,54 @@
+const encoder = new TextEncoder();
+
+export async function hmacSHA256(
+  key: string | ArrayBuffer,
+  data: string
+): Promise<ArrayBuffer> {
+  return hmac("SHA-256", key, data);
+}
+
+// hmacSHA1 is only for the apis that still sign with it (twilio).
+export async function hmacSHA1(
+  key: string | ArrayBuffer,
+  data: string
+): Promise<ArrayBuffer> {
+  return hmac("SHA-1", key, data);
+}
+
+async function hmac(
+  hash: string,
+  key: string | ArrayBuffer,
+  data: string
+): Promise<ArrayBuffer> {
+  const cryptoKey = await crypto.subtle.importKey(
+    "raw",
+    typeof key === "string" ? encoder.encode(key) : key,
+    { name: "HMAC", hash },
+    false,
+    ["sign"]
+  );
+  return crypto.subtle.sign("HMAC", cryptoKey, encoder.encode(data));
+}
+
+export async function sha256(data: string): Promise<ArrayBuffer> {
+  return crypto.subtle.digest("SHA-256", encoder.encode(data));
+}
+
+export function toHex(buf: ArrayBuffer): string {
+  return [...new Uint8Array(buf)]
+    .map((b) => b.toString(16).padStart(2, "0"))
+    .join("");
+}
+
+// safeEqual compares two secrets without giving away (through how long it
+// takes) how much of them matched, by comparing their digests in full.
+export async function safeEqual(a: string, b: string): Promise<boolean> {
+  const [x, y] = (await Promise.all([sha256(a), sha256(b)])).map(
+    (d) => new Uint8Array(d)
+  );
+  let diff = 0;
+  for (let i = 0; i < x.length; i++) {
+    diff |= x[i] ^ y[i];
+  }
+  return diff === 0;
+}
@@ -0,0 +1,116 @@
+// every var looked up so far (in this isolate), set or not, for /config
+const looked = new Set<string>();
+
+// vars set from elsewhere than wrangler.toml (SENSOR_CONFIG_URL), which take
+// precedence over it
+let overrides: Record<string, string> = {};
+
+// overrideVars replaces the vars set by overrideVars before.
+export function overrideVars(vars: Record<string, string>) {
+  overrides = vars;
+}
+
+// optional var bindings are not defined as globals at all when they are left
+// out of wrangler.toml, so they have to be looked up by name.
+export function optionalVar(name: string): string | undefined {
+  looked.add(name);
+  const value = overrides[name] ?? (globalThis as any)[name];
+  if (typeof value !== "string" || value.trim() === "") {
+    return undefined;
+  }
+  return value.trim();
+}
+
+// vars that hold credentials (or urls with credentials in them), going by
+// their name
+const SECRET_VAR =
+  /TOKEN|KEY|SECRET|PASS|SNITCH|WEBHOOK_URL|CONFIG_URL|PUSHOVER_USER|DSN/;
+
+// lookedUpVars is the value of every var looked up so far (null when unset),
+// with secrets redacted down to their last 4 characters (or entirely, when
+// they are too short for that to be safe).
+export function lookedUpVars(): Record<string, string | null> {
+  const vars: Record<string, string | null> = {};
+  for (let name of [...looked].sort()) {
+    const value = optionalVar(name);
+    if (value === undefined) {
+      vars[name] = null;
+    } else if (SECRET_VAR.test(name)) {
+      vars[name] = value.length > 8 ? `****${value.slice(-4)}` : "****";
+    } else {
+      vars[name] = value;
+    }
+  }
+  return vars;
+}
+
+// optionalBinding looks up a binding that is not a var (e.g. an mtls
+// certificate, which is used through its fetch), if it is there at all.
+export function optionalBinding<T>(name: string): T | undefined {
+  const binding = (globalThis as any)[name];
+  if (binding === undefined || binding === null) {
+    return undefined;
+  }
+  if (typeof binding !== "object") {
+    throw new Error(`${name} has to be a binding, not a var`);
+  }
+  return binding as T;
+}
+
+export function listVar(name: string): string[] {
+  return (optionalVar(name) || "")
+    .split(",")
+    .map((s) => s.trim())
+    .filter((s) => s !== "");
+}
+
+const DURATION_UNITS: Record<string, number> = {
+  ms: 1,
+  s: 1000,
+  m: 1000 * 60,
+  h: 1000 * 60 * 60,
+};
+
+// parseDuration accepts go style durations (e.g. "90s", "5m", "1h30m") and
+// returns the number of milliseconds, or NaN if it is not valid.
+export function parseDuration(s: string): number {
+  if (!/^(\d+(\.\d+)?(ms|s|m|h))+$/.test(s)) {
+    return NaN;
+  }
+  let total = 0;
+  for (let match of s.matchAll(/(\d+(?:\.\d+)?)(ms|s|m|h)/g)) {
+    total += parseFloat(match[1]) * DURATION_UNITS[match[2]];
+  }
+  return total;
+}
+
+export function durationVar(name: string, fallback: number): number {
+  const value = optionalVar(name);
+  if (value === undefined) {
+    return fallback;
+  }
+  const d = parseDuration(value);
+  if (isNaN(d)) {
+    throw new Error(`invalid duration for ${name}: "${value}"`);
+  }
+  return d;
+}
+
+export function numberVar(name: string, fallback: number): number {
+  const value = optionalVar(name);
+  if (value === undefined) {
+    return fallback;
+  }
+  const n = Number(value);
+  if (isNaN(n)) {
+    throw new Error(`invalid number for ${name}: "${value}"`);
+  }
+  return n;
+}
+
+export function boolVar(name: string): boolean {
+  const value = optionalVar(name);
+  return (
+    value !== undefined && ["1", "true", "yes"].includes(value.toLowerCase())
+  );
+}
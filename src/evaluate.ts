@@ -0,0 +1,185 @@
+import { AirQualityIndex, compareCategories } from "./aqi";
+import { Location } from "./locations";
+import { logInfo } from "./newRelic";
+import { AirQualityEvent, Notification, trendOf } from "./notifier";
+import { SensorResults } from "./purpleAir";
+import { QuietHours } from "./quietHours";
+import { AirQualityZone, State } from "./state";
+import { MessageTemplate } from "./template";
+
+// Thresholds are the AQI the air turns bad above, and good again at.
+export type Thresholds = {
+  low: number;
+  high: number;
+};
+
+// DecisionMetric is which reading crosses the thresholds (DECISION_METRIC).
+export type DecisionMetric = "tenm" | "rt" | "blend";
+
+export const DECISION_METRICS: DecisionMetric[] = ["tenm", "rt", "blend"];
+
+// Settings are what evaluate goes by, read from the vars once per check.
+export type Settings = {
+  location: Location;
+  index: AirQualityIndex;
+  precision: number; // AQI_PRECISION
+  thresholds: Thresholds;
+  decision: DecisionMetric;
+  templates: Partial<Record<AirQualityEvent, MessageTemplate>>;
+  schedule: number[];
+  cooldown: number; // milliseconds
+  quiet: QuietHours | null;
+  noteBackup: boolean;
+};
+
+// zoneOf is the zone results are in, going by the high threshold alone.
+export function zoneOf(
+  results: SensorResults,
+  settings: Settings
+): AirQualityZone {
+  const aqi = Math.round(decisionValue(results, settings.decision));
+  return aqi > settings.thresholds.high ? "bad" : "good";
+}
+
+function decisionValue(
+  results: SensorResults,
+  metric: DecisionMetric
+): number {
+  switch (metric) {
+    case "rt":
+      return results.realtime;
+    case "blend":
+      return (results.realtime + results.tenMinuteAvg) / 2;
+  }
+  return results.tenMinuteAvg;
+}
+
+// evaluate decides what (if anything) to notify about, given the stored state
+// and new readings taken at now (unix epoch, milliseconds), and returns the
+// state to store next. it stores and sends nothing itself, so that /replay
+// can run past readings through it.
+export function evaluate(
+  state: State & { lastReadings: SensorResults },
+  results: SensorResults,
+  now: number,
+  settings: Settings
+): { state: State; notification: Notification | null } {
+  const { index, thresholds, schedule } = settings;
+  const lastReadings = state.lastReadings;
+  let zone = state.zone || zoneOf(lastReadings, settings);
+  const previousCategory = index.category(lastReadings.tenMinuteAvg);
+  const category = index.category(results.tenMinuteAvg);
+  // thresholds are crossed by whole numbers, whatever AQI_PRECISION is
+  const aqi = Math.round(decisionValue(results, settings.decision));
+  let event: AirQualityEvent | null = null;
+  if (zone === "bad" && aqi <= thresholds.low) {
+    zone = "good";
+    event = "air_quality_good";
+  } else if (zone === "good" && aqi > thresholds.high) {
+    zone = "bad";
+    event = "air_quality_bad";
+  } else if (zone === "bad") {
+    // while the air is bad, every change in category is worth mentioning
+    const change = compareCategories(index, category, previousCategory);
+    if (change > 0) {
+      event = "air_quality_worse";
+    } else if (change < 0) {
+      event = "air_quality_better";
+    }
+  }
+  let badSince: number | undefined = undefined;
+  if (zone === "bad") {
+    badSince = event === "air_quality_bad" ? now : state.badSince || now;
+  }
+  // while the air stays bad, remind at each interval of the schedule
+  // (repeating the last one) since the last notification about it
+  let escalation = state.escalation;
+  if (zone === "good" || schedule.length === 0) {
+    escalation = undefined;
+  } else if (event) {
+    escalation = {
+      step: event === "air_quality_bad" ? 0 : escalation?.step || 0,
+      at: now,
+    };
+  } else if (!escalation) {
+    escalation = { step: 0, at: now };
+  } else if (state.acknowledged === badSince) {
+    // someone acknowledged this episode (from slack), so no more reminders
+  } else if (
+    now - escalation.at >=
+    schedule[Math.min(escalation.step, schedule.length - 1)]
+  ) {
+    event = "air_quality_still_bad";
+    escalation = { step: escalation.step + 1, at: now };
+  }
+  const lastNotified = { ...state.lastNotified };
+  if (event) {
+    const last = lastNotified[event];
+    if (last !== undefined && now - last < settings.cooldown) {
+      logInfo("already notified about this recently, skipping", {
+        event,
+        lastNotified: new Date(last),
+      });
+      event = null;
+    } else {
+      lastNotified[event] = now;
+    }
+  } else {
+    logInfo("nothing to alert about");
+  }
+  let notification: Notification | null = event
+    ? {
+        event,
+        readings: results,
+        category,
+        previousCategory,
+        index: index.name,
+        precision: settings.precision,
+        trend: trendOf(
+          lastReadings,
+          results,
+          state.lastFetch ? now - state.lastFetch : 0,
+          index
+        ),
+        location: settings.location.name,
+        noteBackup: settings.noteBackup,
+        episode: badSince,
+      }
+    : null;
+  const template = event && settings.templates[event];
+  if (notification && template) {
+    notification.message = template.render(notification);
+  }
+  let deferred = state.deferred;
+  const quiet = settings.quiet;
+  if (quiet && quiet.active(new Date(now))) {
+    if (notification && quiet.mode === "defer") {
+      logInfo("quiet hours, deferring notification", { event });
+      deferred = notification;
+    } else if (notification) {
+      logInfo("quiet hours, dropping notification", { event });
+    }
+    notification = null;
+  } else if (deferred) {
+    // anything that just happened is more relevant than what was deferred
+    if (!notification) {
+      logInfo("quiet hours are over, sending deferred notification");
+      notification = deferred;
+    }
+    deferred = undefined;
+  }
+  return {
+    state: {
+      ...state,
+      lastReadings: results,
+      lastFetch: now,
+      zone,
+      lastNotified,
+      deferred,
+      escalation,
+      badSince,
+      acknowledged: badSince === undefined ? undefined : state.acknowledged,
+    },
+    notification,
+  };
+}
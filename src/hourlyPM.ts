@@ -0,0 +1,42 @@
+import { locationKey } from "./state";
+
+const HOURLY_PM_KEY = "hourly_pm";
+const HOUR = 1000 * 60 * 60;
+const HOURS = 12;
+
+type Bucket = {
+  hour: number; // hours since the unix epoch
+  total: number;
+  count: number;
+};
+
+// recordHourlyPM adds a PM2.5 reading to the average for the current hour,
+// and returns the averages for the last 12 hours (the current, in progress,
+// hour first) with NaN for hours that have no readings.
+export async function recordHourlyPM(
+  kv: KVNamespace,
+  pm: number,
+  now: number,
+  location?: string
+): Promise<number[]> {
+  const key = locationKey(HOURLY_PM_KEY, location);
+  const hour = Math.floor(now / HOUR);
+  let buckets = await kv.get<Bucket[]>(key, "json").catch(() => null);
+  buckets = (Array.isArray(buckets) ? buckets : []).filter(
+    (b) => b.hour > hour - HOURS
+  );
+  let current = buckets.find((b) => b.hour === hour);
+  if (!current) {
+    current = { hour, total: 0, count: 0 };
+    buckets.push(current);
+  }
+  current.total += pm;
+  current.count++;
+  await kv.put(key, JSON.stringify(buckets));
+  const averages: number[] = [];
+  for (let i = 0; i < HOURS; i++) {
+    const b = buckets.find((b) => b.hour === hour - i);
+    averages.push(b ? b.total / b.count : NaN);
+  }
+  return averages;
+}
@@ -0,0 +1,73 @@
+import { logWarn } from "./newRelic";
+
+export type RetryPolicy = {
+  retries: number;
+  waitMin: number; // milliseconds
+  waitMax: number; // milliseconds
+  timeout: number; // milliseconds for each attempt, 0 waits as long as it takes
+};
+
+// fetchWithRetry retries requests that fail outright or come back with a 429
+// or 5xx, doubling the wait (from waitMin, up to waitMax) after each attempt.
+// once the retries are used up, the last response (or error) is returned as is.
+export async function fetchWithRetry(
+  url: string,
+  init: RequestInit,
+  policy: RetryPolicy
+): Promise<Response> {
+  for (let attempt = 0; ; attempt++) {
+    let status: number | undefined;
+    try {
+      const response = await fetchWithTimeout(url, init, policy.timeout);
+      if (!retryable(response.status) || attempt >= policy.retries) {
+        return response;
+      }
+      status = response.status;
+      await response.body?.cancel();
+    } catch (e) {
+      if (attempt >= policy.retries) {
+        throw e;
+      }
+    }
+    const wait = Math.min(
+      policy.waitMax,
+      policy.waitMin * Math.pow(2, attempt)
+    );
+    // only the host is logged, some apis take their key in the query string
+    logWarn("request failed, retrying", {
+      host: new URL(url).host,
+      status,
+      attempt: attempt + 1,
+      wait,
+    });
+    await new Promise((resolve) => setTimeout(resolve, wait));
+  }
+}
+
+// fetchWithTimeout gives up on a request that hasn't started responding
+// within timeout milliseconds (0 disables this).
+export async function fetchWithTimeout(
+  url: string,
+  init: RequestInit,
+  timeout: number
+): Promise<Response> {
+  if (timeout <= 0) {
+    return fetch(url, init);
+  }
+  const controller = new AbortController();
+  const timer = setTimeout(() => controller.abort(), timeout);
+  try {
+    return await fetch(url, { ...init, signal: controller.signal });
+  } catch (e) {
+    if (controller.signal.aborted) {
+      throw new Error(`request to ${new URL(url).host} timed out`);
+    }
+    throw e;
+  } finally {
+    clearTimeout(timer);
+  }
+}
+
+function retryable(status: number): boolean {
+  return status === 429 || status >= 500;
+}
@@ -0,0 +1,49 @@
+import { roundAQI } from "./aqi";
+import {
+  AirQualityEvent,
+  noticeOf,
+  Notification,
+  Notifier,
+} from "./notifier";
+import { userAgent } from "./version";
+
+export type IFTTTConfig = {
+  key: string;
+  // the IFTTT webhook event to trigger for each of our events, defaulting to
+  // the event's own name
+  eventNames: Partial<Record<AirQualityEvent, string>>;
+};
+
+export class IFTTTNotifier implements Notifier {
+  constructor(private config: IFTTTConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    if (noticeOf(n)) {
+      // applets go by the event, which would set off the bad/good one
+      return;
+    }
+    const eventName = this.config.eventNames[n.event] || n.event;
+    let response = await fetch(
+      `https://maker.ifttt.com/trigger/${encodeURIComponent(
+        eventName
+      )}/with/key/${this.config.key}`,
+      {
+        method: "POST",
+        headers: {
+          "user-agent": userAgent(),
+          "content-type": "application/json",
+        },
+        body: JSON.stringify({
+          value1: roundAQI(n.readings.realtime, n.precision || 0),
+          value2: roundAQI(n.readings.tenMinuteAvg, n.precision || 0),
+          value3: n.category,
+        }),
+      }
+    );
+    if (!response.ok) {
+      throw new Error(
+        `non-ok status returned from ifttt (${response.status}): ${await response.text()}`
+      );
+    }
+  }
+}
@@ -0,0 +1,97 @@
+// Location is a site that is checked, and notified about, on its own. the
+// default location (no name) is configured by the top level vars, named ones
+// by LOCATIONS.
+export type Location = {
+  name?: string;
+  sensorIDs?: string[];
+  // all or nothing: a location with any threshold set ignores AQ_THRESHOLD*
+  thresholds?: LocationThresholds;
+  notifiers?: string[]; // only notify these, instead of every configured one
+};
+
+// thresholds are kept as configured (an AQI or a category name) and parsed
+// along with the top level ones.
+export type LocationThresholds = {
+  threshold?: string;
+  high?: string;
+  low?: string;
+};
+
+// parseLocations parses LOCATIONS, a json list like:
+//
+//   [{"name": "home", "sensor_ids": ["1234"]},
+//    {"name": "office", "sensor_ids": ["5678"], "threshold": "unhealthy",
+//     "notifiers": ["telegram"]}]
+export function parseLocations(raw: string): Location[] {
+  let parsed: unknown;
+  try {
+    parsed = JSON.parse(raw);
+  } catch (e) {
+    throw new Error(`LOCATIONS is not valid json: ${e.message}`);
+  }
+  if (!Array.isArray(parsed) || parsed.length === 0) {
+    throw new Error("LOCATIONS must be a non-empty json list");
+  }
+  const names = new Set<string>();
+  return parsed.map((l: any, i): Location => {
+    if (typeof l?.name !== "string" || !/^[\w-]+$/.test(l.name)) {
+      throw new Error(
+        `LOCATIONS[${i}] needs a name made of letters, numbers, "_" and "-"`
+      );
+    }
+    if (names.has(l.name)) {
+      throw new Error(`LOCATIONS has more than one "${l.name}"`);
+    }
+    names.add(l.name);
+    const location: Location = {
+      name: l.name,
+      sensorIDs: stringList(l.name, "sensor_ids", l.sensor_ids),
+    };
+    if (location.sensorIDs?.length === 0) {
+      throw new Error(`location "${l.name}" needs at least one of sensor_ids`);
+    }
+    const t = {
+      threshold: stringOf(l.name, "threshold", l.threshold),
+      high: stringOf(l.name, "threshold_high", l.threshold_high),
+      low: stringOf(l.name, "threshold_low", l.threshold_low),
+    };
+    if (Object.values(t).some((v) => v !== undefined)) {
+      location.thresholds = t;
+    }
+    if (l.notifiers !== undefined) {
+      location.notifiers = stringList(l.name, "notifiers", l.notifiers);
+    }
+    return location;
+  });
+}
+
+function stringOf(
+  location: string,
+  field: string,
+  value: unknown
+): string | undefined {
+  if (value === undefined || value === null) {
+    return undefined;
+  }
+  if (typeof value !== "string" && typeof value !== "number") {
+    throw new Error(
+      `${field} of location "${location}" must be a string or a number`
+    );
+  }
+  return String(value);
+}
+
+function stringList(location: string, field: string, value: unknown): string[] {
+  if (!Array.isArray(value)) {
+    throw new Error(`${field} of location "${location}" must be a list`);
+  }
+  return value.map((v) => {
+    const entry = stringOf(location, field, v)?.trim();
+    if (!entry) {
+      throw new Error(
+        `${field} of location "${location}" must not have empty entries`
+      );
+    }
+    return entry;
+  });
+}
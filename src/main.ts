@@ -1,150 +1,2102 @@
-import { Buffer } from "buffer/";
-import { flushToString as flushLogs, logError, logInfo } from "./newRelic";
-import { getSensorData, SensorResults } from "./purpleAir";
-
-// var bindings
-declare const SMS_RECIPIENTS: string;
-declare const TWILIO_FROM: string;
-declare const TWILIO_ACCOUNT_SID: string;
-declare const TWILIO_AUTH_TOKEN: string;
-declare const SENSOR_IDS: string;
+import { AirNowSource } from "./airNow";
+import { AQICNSource } from "./aqicn";
+import {
+  aqiCategories,
+  AirQualityIndex,
+  findCategory,
+  INDICES,
+  nowCast,
+  roundAQI,
+  roundReadings,
+  US_AQI,
+} from "./aqi";
+import {
+  BreakerConfig,
+  breakerFailure,
+  breakerStatus,
+  breakerSuccess,
+} from "./breaker";
+import { safeEqual } from "./crypto";
+import {
+  boolVar,
+  durationVar,
+  listVar,
+  lookedUpVars,
+  numberVar,
+  optionalBinding,
+  optionalVar,
+  overrideVars,
+  parseDuration,
+} from "./env";
+import {
+  DECISION_METRICS,
+  DecisionMetric,
+  evaluate,
+  Settings,
+  Thresholds,
+  zoneOf,
+} from "./evaluate";
+import { recordHourlyPM } from "./hourlyPM";
+import { fetchWithTimeout, RetryPolicy } from "./http";
+import { IFTTTNotifier } from "./ifttt";
+import { Location, parseLocations } from "./locations";
+import { MatrixNotifier } from "./matrix";
+import {
+  pushReadings,
+  recordFetchError,
+  recordNotification,
+  recordSMSStatus,
+  renderMetrics,
+} from "./metrics";
+import { MQTTPublisher } from "./mqtt";
+import {
+  flushToString as flushLogs,
+  logError,
+  logInfo,
+  logWarn,
+} from "./newRelic";
+import {
+  AirQualityEvent,
+  composeMessage,
+  MultiNotifier,
+  Notice,
+  Notification,
+  Notifier,
+} from "./notifier";
+import { NtfyNotifier } from "./ntfy";
+import { PagerDutyNotifier } from "./pagerDuty";
+import {
+  loadProfileName,
+  parseProfiles,
+  Profiles,
+  storeProfileName,
+} from "./profiles";
+import {
+  Aggregate,
+  AGGREGATES,
+  LocalPurpleAirSource,
+  PurpleAirGroupSource,
+  PurpleAirOptions,
+  PurpleAirSource,
+  SensorResults,
+  sensorInfo,
+} from "./purpleAir";
+import { PushoverNotifier } from "./pushover";
+import { QuietHours } from "./quietHours";
+import {
+  appendReading,
+  LoggedReading,
+  loadReadings,
+  parseReadings,
+  renderReadings,
+} from "./readingsLog";
+import { recordSample, rollingAverage } from "./samples";
+import { loadSensorConfig } from "./sensorConfig";
+import { captureError, parseDSN } from "./sentry";
+import {
+  Acknowledgement,
+  parseAcknowledgement,
+  SlackNotifier,
+  verifySlackRequest,
+} from "./slack";
+import { SNSNotifier } from "./sns";
+import {
+  checkReadings,
+  SensorSource,
+  SourceError,
+  StaleDataError,
+  UpstreamSchemaError,
+} from "./source";
+import {
+  AirQualityZone,
+  loadState,
+  locationKey,
+  saveState,
+  State,
+} from "./state";
+import { TelegramNotifier } from "./telegram";
+import { MessageTemplate } from "./template";
+import {
+  parseRecipients,
+  SMSNotifier,
+  verifyTwilioRequest,
+} from "./twilio";
+import { buildInfo, userAgent } from "./version";
+import { WebhookNotifier } from "./webhook";
 
 // kv bindings
 declare const STATE: KVNamespace;
 
 addEventListener("fetch", (event) => {
-  const url = new URL(event.request.url);
+  event.respondWith(handleRequest(event.request));
+});
+
+async function handleRequest(request: Request): Promise<Response> {
+  const url = new URL(request.url);
+  await applyOverrides();
   if (url.searchParams.get("debug_mode")) {
-    event.respondWith(
-      checkAirQuality().then(() => {
-        return new Response(flushLogs(), {
-          headers: {
-            "content-type": "text/plain",
-          },
-        });
-      })
+    await checkAllLocations();
+    return new Response(flushLogs(), {
+      headers: {
+        "content-type": "text/plain",
+      },
+    });
+  }
+  switch (url.pathname) {
+    case "/metrics":
+      return new Response(
+        await renderMetrics(STATE, await loadStates(), aqiPrecision()),
+        { headers: { "content-type": "text/plain; version=0.0.4" } }
+      );
+    case "/healthz":
+      return healthResponse();
+    case "/check":
+      return checkResponse(request, url.searchParams.get("location"));
+    case "/version":
+      return jsonResponse(buildInfo);
+    case "/categories":
+      return jsonResponse(aqiCategories());
+    case "/sensor":
+      return sensorResponse(
+        request,
+        url.searchParams.get("id") || listVar("SENSOR_IDS")[0]
+      );
+    case "/aqi":
+      return aqiResponse(url.searchParams.get("location"));
+    case "/readings":
+      return readingsResponse(url.searchParams.get("location"));
+    case "/send_test":
+      return sendTestResponse(request, url.searchParams.get("location"));
+    case "/config":
+      return configResponse(request);
+    case "/replay":
+      return replayResponse(request, url.searchParams);
+    case "/profile":
+      return profileResponse(request, url.searchParams);
+    case "/twilio/status":
+      return twilioStatusResponse(request);
+    case "/slack/interactions":
+      return slackInteractionResponse(request);
+  }
+  return new Response("hello...", {
+    headers: { "content-type": "application/json" },
+  });
+}
+
+function jsonResponse(body: unknown, status = 200): Response {
+  return new Response(JSON.stringify(body), {
+    status,
+    headers: { "content-type": "application/json" },
+  });
+}
+
+const HEALTH_STALE_AFTER = 1000 * 60 * 10; // 10 minutes
+
+// loadStates loads the stored state of every location, keyed by name ("" for
+// the default location).
+async function loadStates(): Promise<Map<string, State | null>> {
+  const states = new Map<string, State | null>();
+  for (let location of locations()) {
+    states.set(location.name || "", await loadState(STATE, location.name));
+  }
+  return states;
+}
+
+// healthResponse is healthy as long as the last successful fetch happened
+// within HEALTH_STALE_AFTER. with LOCATIONS, it has to have happened for
+// every location.
+async function healthResponse(): Promise<Response> {
+  // with a schedule that doesn't parse no check ever runs, which is worth
+  // failing on right away instead of once the last readings go stale
+  try {
+    checkInterval();
+  } catch (e) {
+    return jsonResponse({ healthy: false, error: e.message }, 503);
+  }
+  const staleAfter = durationVar("HEALTH_STALE_AFTER", HEALTH_STALE_AFTER);
+  const precision = aqiPrecision();
+  const health: Record<string, ReturnType<typeof locationHealth>> = {};
+  for (let [name, state] of await loadStates()) {
+    health[name] = locationHealth(state, staleAfter, precision);
+  }
+  const single = health[""];
+  if (single) {
+    return jsonResponse(single, single.healthy ? 200 : 503);
+  }
+  const healthy = Object.values(health).every((h) => h.healthy);
+  return jsonResponse({ healthy, locations: health }, healthy ? 200 : 503);
+}
+
+function locationHealth(
+  state: State | null,
+  staleAfter: number,
+  precision: number
+) {
+  const lastFetch = state?.lastFetch;
+  const healthy = !!lastFetch && Date.now() - lastFetch <= staleAfter;
+  return {
+    healthy,
+    lastFetch: lastFetch ? new Date(lastFetch) : null,
+    lastReadings: state?.lastReadings
+      ? roundReadings(state.lastReadings, precision)
+      : null,
+    lastError: state?.lastError
+      ? { ...state.lastError, at: new Date(state.lastError.at) }
+      : null,
+    breaker: {
+      status: breakerStatus(state?.breaker, Date.now()),
+      failures: state?.breaker?.failures || 0,
+      openUntil: state?.breaker?.openUntil
+        ? new Date(state.breaker.openUntil)
+        : null,
+    },
+  };
+}
+
+// checkResponse takes a one-off reading, without touching the stored state or
+// notifying anyone, for use from scripts. it takes ADMIN_TOKEN, since every
+// reading is fetched from upstream whatever CHECK_INTERVAL is.
+async function checkResponse(
+  request: Request,
+  name: string | null
+): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  let location: Location;
+  try {
+    location = findLocation(name);
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+  try {
+    const index = airQualityIndex();
+    const results = await initSource(location).readings();
+    return jsonResponse({
+      ...roundReadings(results, aqiPrecision()),
+      index: index.name,
+      category: index.category(results.tenMinuteAvg),
+    });
+  } catch (e) {
+    const kind = e instanceof SourceError ? e.kind : undefined;
+    return jsonResponse({ error: e.message, kind }, 502);
+  }
+}
+
+// aqiResponse returns the readings of the last check, as stored, without
+// fetching anything (unlike /check).
+async function aqiResponse(name: string | null): Promise<Response> {
+  let location: Location;
+  let index: AirQualityIndex;
+  let precision: number;
+  try {
+    location = findLocation(name);
+    index = airQualityIndex();
+    precision = aqiPrecision();
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+  const state = await loadState(STATE, location.name);
+  const readings = state?.lastReadings;
+  if (!readings || !state?.lastFetch) {
+    return jsonResponse(
+      {
+        error: "no readings have been fetched yet",
+        last_error: state?.lastError?.message || null,
+      },
+      503
+    );
+  }
+  return jsonResponse({
+    rt: roundAQI(readings.realtime, precision),
+    tenmavg: roundAQI(readings.tenMinuteAvg, precision),
+    category: index.category(readings.tenMinuteAvg),
+    index: index.name,
+    sensor_id: readings.sensorID || null,
+    fetched_at: new Date(state.lastFetch).toJSON(),
+    from_backup: !!readings.backup,
+  });
+}
+
+async function readingsResponse(name: string | null): Promise<Response> {
+  let location: Location;
+  let precision: number;
+  try {
+    location = findLocation(name);
+    precision = aqiPrecision();
+  } catch (e) {
+    return new Response(`${e.message}\n`, { status: 400 });
+  }
+  return new Response(
+    renderReadings(await loadReadings(STATE, location.name), precision),
+    { headers: { "content-type": "application/x-ndjson" } }
+  );
+}
+
+// sendTestResponse sends a clearly labelled test notification, made from the
+// last readings, through the same notifiers a real one would go to.
+async function sendTestResponse(
+  request: Request,
+  name: string | null
+): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  if (request.method !== "POST") {
+    return jsonResponse({ error: "send_test only accepts POST" }, 405);
+  }
+  let location: Location;
+  let index: AirQualityIndex;
+  let precision: number;
+  try {
+    location = findLocation(name);
+    index = airQualityIndex();
+    precision = aqiPrecision();
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+  const state = await loadState(STATE, location.name);
+  const readings = state?.lastReadings;
+  if (!readings) {
+    return jsonResponse(
+      { error: "there are no readings yet, try again after the next check" },
+      409
     );
+  }
+  const category = index.category(readings.tenMinuteAvg);
+  const notification: Notification = {
+    event: state?.zone === "bad" ? "air_quality_bad" : "air_quality_good",
+    readings,
+    category,
+    previousCategory: category,
+    index: index.name,
+    precision,
+    location: location.name,
+    test: true,
+  };
+  try {
+    await initNotifier(location.notifiers).notify(notification);
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 502);
+  }
+  return jsonResponse({ sent: notification });
+}
+
+// configResponse shows the configuration as it is resolved: every var that is
+// looked up along the way (secrets redacted), what came of them, and the
+// errors a check would run into.
+async function configResponse(request: Request): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  const resolved: Record<string, unknown> = {};
+  const errors: Record<string, string> = {};
+  const resolve = (name: string, f: () => unknown) => {
+    try {
+      resolved[name] = f();
+    } catch (e) {
+      errors[name] = e.message;
+    }
+  };
+  resolve("check_interval", () => checkInterval());
+  resolve("profiles", () => Object.keys(profiles()));
+  resolve("check_jitter", () => checkJitter());
+  resolve("fetch_concurrency", () => fetchConcurrency());
+  resolve("sensor_config_refresh", () =>
+    durationVar("SENSOR_CONFIG_REFRESH", SENSOR_CONFIG_REFRESH)
+  );
+  resolve("index", () => airQualityIndex().name);
+  resolve("aqi_precision", () => aqiPrecision());
+  resolve("decision_metric", () => decisionMetric());
+  resolve("warmup_checks", () => warmupChecks());
+  resolve("locations", () =>
+    locations().map((location) => {
+      initSource(location);
+      initNotifier(location.notifiers);
+      return {
+        name: location.name || null,
+        sensor_ids: location.sensorIDs || null,
+        thresholds: aqThresholds(location),
+        notifiers: location.notifiers || null,
+      };
+    })
+  );
+  resolve("notifiers", () => configuredNotifiers().map(([name]) => name));
+  resolve("webhook_mtls", () => !!webhookClientCert());
+  resolve("sentry", () => {
+    const dsn = optionalVar("SENTRY_DSN");
+    return dsn ? parseDSN(dsn).storeURL : null;
+  });
+  resolve("templates", () => Object.keys(messageTemplates()));
+  resolve("escalation_schedule", () => escalationSchedule());
+  resolve("quiet_hours", () => quietHours()?.mode || null);
+  resolve("breaker", () => breakerConfig());
+  resolve("retry", () => retryPolicy());
+  resolve("notify_timeout", () =>
+    durationVar("NOTIFY_TIMEOUT", NOTIFY_TIMEOUT)
+  );
+  resolve("readings_log", () => boolVar("READINGS_LOG"));
+  resolve("readings_log_limit", () => readingsLogLimit());
+  resolve("nowcast", () => boolVar("NOWCAST"));
+  resolve("rolling_window_rt", () => durationVar("ROLLING_WINDOW_RT", 0));
+  resolve("rolling_window", () => durationVar("ROLLING_WINDOW", 0));
+  resolve("notify_on_start", () => boolVar("NOTIFY_ON_START"));
+  resolve("notify_cooldown", () => durationVar("NOTIFY_COOLDOWN", 0));
+  resolve("note_backup", () => boolVar("NOTE_BACKUP"));
+  resolve("backup_alert_after", () => durationVar("BACKUP_ALERT_AFTER", 0));
+  resolve("flatline_checks", () => numberVar("FLATLINE_CHECKS", 0));
+  resolve("mqtt", () => !!optionalVar("MQTT_BROKER"));
+  resolve("snitch_interval", () => durationVar("SNITCH_INTERVAL", 0));
+  resolve("health_stale_after", () =>
+    durationVar("HEALTH_STALE_AFTER", HEALTH_STALE_AFTER)
+  );
+  resolve("user_agent", () => userAgent());
+  // durations are in milliseconds
+  return jsonResponse({ vars: lookedUpVars(), resolved, errors });
+}
+
+// replayResponse runs past readings (POSTed as json lines, like /readings
+// returns them, or else the stored readings log) through the same decisions a
+// check makes, and lists the notifications that would have gone out. nothing
+// is stored or sent. ?threshold=, ?threshold_high= and ?threshold_low= try
+// out other thresholds than the configured ones.
+async function replayResponse(
+  request: Request,
+  params: URLSearchParams
+): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  if (request.method !== "POST") {
+    return jsonResponse({ error: "replay only accepts POST" }, 405);
+  }
+  let settings: Settings;
+  let readings: LoggedReading[];
+  try {
+    let location = findLocation(params.get("location"));
+    const thresholds = {
+      threshold: params.get("threshold") || undefined,
+      high: params.get("threshold_high") || undefined,
+      low: params.get("threshold_low") || undefined,
+    };
+    if (Object.values(thresholds).some((t) => t !== undefined)) {
+      location = { ...location, thresholds };
+    }
+    settings = evaluationSettings(location);
+    const body = await request.text();
+    readings = body.trim()
+      ? parseReadings(body)
+      : await loadReadings(STATE, location.name);
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+  const notifications: unknown[] = [];
+  let state: (State & { lastReadings: SensorResults }) | null = null;
+  for (let r of readings) {
+    const now = Date.parse(r.timestamp);
+    const results: SensorResults = {
+      realtime: r.rt,
+      tenMinuteAvg: r.tenmavg,
+      sensorID: r.sensor_id || undefined,
+    };
+    if (!state) {
+      state = {
+        lastReadings: results,
+        lastFetch: now,
+        zone: zoneOf(results, settings),
+      };
+      continue;
+    }
+    const next = evaluate(state, results, now, settings);
+    state = { ...next.state, lastReadings: results };
+    if (next.notification) {
+      notifications.push({
+        timestamp: r.timestamp,
+        event: next.notification.event,
+        category: next.notification.category,
+        message: composeMessage(next.notification),
+      });
+    }
+  }
+  return jsonResponse({
+    readings: readings.length,
+    thresholds: settings.thresholds,
+    decision_metric: settings.decision,
+    notifications,
+  });
+}
+
+// profileResponse shows the active profile, and with a POST picks another
+// (?name=smoke), which sticks until the next one is picked. ?name= (empty)
+// goes back to PROFILE.
+async function profileResponse(
+  request: Request,
+  params: URLSearchParams
+): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  try {
+    if (request.method === "POST") {
+      const name = params.get("name");
+      if (name === null) {
+        return jsonResponse({ error: "name is required" }, 400);
+      }
+      if (name && !Object.keys(profiles()).includes(name)) {
+        return jsonResponse({ error: `unknown profile "${name}"` }, 400);
+      }
+      await storeProfileName(STATE, name || null);
+      logInfo("profile picked", { profile: name || null });
+    }
+    const active = await activeProfile();
+    return jsonResponse({ ...active, profiles: Object.keys(profiles()) });
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+}
+
+// twilio's final word on a message, the rest (queued, sent, ...) are on the
+// way there
+const TWILIO_FINAL = ["delivered", "undelivered", "failed"];
+
+// twilioStatusResponse receives twilio's status callbacks (to
+// TWILIO_STATUS_CALLBACK), logging whether each message got delivered and
+// counting it in /metrics.
+async function twilioStatusResponse(request: Request): Promise<Response> {
+  const callback = optionalVar("TWILIO_STATUS_CALLBACK");
+  const authToken = optionalVar("TWILIO_AUTH_TOKEN");
+  if (!callback || !authToken) {
+    return jsonResponse({ error: "TWILIO_STATUS_CALLBACK is not set" }, 404);
+  }
+  const params = new URLSearchParams(await request.text());
+  const signature = request.headers.get("x-twilio-signature") || "";
+  if (!(await verifyTwilioRequest(authToken, callback, params, signature))) {
+    return jsonResponse({ error: "invalid signature" }, 401);
+  }
+  const status = params.get("MessageStatus") || "";
+  const fields = {
+    sid: params.get("MessageSid"),
+    to: params.get("To"),
+    status,
+  };
+  if (!TWILIO_FINAL.includes(status)) {
+    logInfo("sms status", fields);
+  } else if (status === "delivered") {
+    logInfo("sms was delivered", fields);
+    await recordSMSStatus(STATE, status);
   } else {
-    event.respondWith(
-      new Response("hello...", {
-        headers: { "content-type": "application/json" },
-      })
+    logWarn("sms was not delivered", {
+      ...fields,
+      errorCode: params.get("ErrorCode"),
+    });
+    await recordSMSStatus(STATE, status);
+  }
+  return new Response(null, { status: 204 });
+}
+
+// slackInteractionResponse receives the button presses on slack messages
+// (the interactivity request url of the slack app). acknowledging the bad air
+// stops the reminders about it until the air has been good again.
+async function slackInteractionResponse(request: Request): Promise<Response> {
+  const secret = optionalVar("SLACK_SIGNING_SECRET");
+  if (!secret) {
+    return jsonResponse({ error: "SLACK_SIGNING_SECRET is not set" }, 404);
+  }
+  const body = await request.text();
+  if (!(await verifySlackRequest(secret, request.headers, body, Date.now()))) {
+    return jsonResponse({ error: "invalid signature" }, 401);
+  }
+  let ack: Acknowledgement | null;
+  let location: Location;
+  try {
+    ack = parseAcknowledgement(body);
+    if (!ack) {
+      return new Response(null, { status: 200 });
+    }
+    location = findLocation(ack.location || null);
+  } catch (e) {
+    return jsonResponse({ error: e.message }, 400);
+  }
+  const state = await loadState(STATE, location.name);
+  let text: string;
+  if (!state || state.zone !== "bad" || state.badSince !== ack.episode) {
+    text = "that bad air is over already, nothing to acknowledge";
+  } else {
+    await saveState(
+      STATE,
+      { ...state, acknowledged: ack.episode },
+      stateTTL(),
+      location.name
     );
+    logInfo("bad air acknowledged", {
+      location: location.name,
+      user: ack.user,
+    });
+    text = `👍 <@${ack.user}> acknowledged, no more reminders until the air is good again`;
   }
-});
+  if (ack.responseURL) {
+    try {
+      await fetch(ack.responseURL, {
+        method: "POST",
+        headers: { "content-type": "application/json" },
+        body: JSON.stringify({ replace_original: false, text }),
+      });
+    } catch (e) {
+      logWarn("failed to reply to slack", { error: e.message });
+    }
+  }
+  return new Response(null, { status: 200 });
+}
+
+// checkAdmin returns an error response unless the request has ADMIN_TOKEN as
+// a bearer token. the endpoints that need it are disabled until it is set.
+async function checkAdmin(request: Request): Promise<Response | null> {
+  const token = optionalVar("ADMIN_TOKEN");
+  if (!token) {
+    return jsonResponse({ error: "ADMIN_TOKEN is not set" }, 404);
+  }
+  const authorization = request.headers.get("authorization") || "";
+  if (!(await safeEqual(authorization, `Bearer ${token}`))) {
+    return jsonResponse({ error: "unauthorized" }, 401);
+  }
+  return null;
+}
+
+// sensorResponse describes a PurpleAir sensor as a plain text table, to check
+// that an id is the right sensor before using it. it takes ADMIN_TOKEN, since
+// looking up any sensor id spends the deployment's PurpleAir api points.
+async function sensorResponse(
+  request: Request,
+  sensorID: string | undefined
+): Promise<Response> {
+  const denied = await checkAdmin(request);
+  if (denied) {
+    return denied;
+  }
+  if (!sensorID) {
+    return new Response("missing ?id=<sensor id>\n", { status: 400 });
+  }
+  let rows: [string, string][];
+  try {
+    const options = purpleAirOptions();
+    const info = await sensorInfo(sensorID, options);
+    const index = options.index;
+    const precision = aqiPrecision();
+    const aqi = (n: number) =>
+      `${roundAQI(n, precision)} (${index.category(n)})`;
+    rows = [
+      ["sensor", sensorID],
+      ["label", info.label || "-"],
+      [
+        "location",
+        info.latitude !== undefined && info.longitude !== undefined
+          ? `${info.latitude}, ${info.longitude}`
+          : "-",
+      ],
+      ["last seen", info.lastSeen.toJSON()],
+      ["firmware", info.firmware || "-"],
+    ];
+    if (info.results) {
+      const name = index.name.toLowerCase();
+      rows.push([`realtime ${name}`, aqi(info.results.realtime)]);
+      rows.push([`10 minute ${name}`, aqi(info.results.tenMinuteAvg)]);
+    } else {
+      rows.push(["readings", `unusable: ${info.error}`]);
+    }
+  } catch (e) {
+    return new Response(`failed to look up sensor: ${e.message}\n`, {
+      status: 502,
+    });
+  }
+  const width = Math.max(...rows.map(([label]) => label.length));
+  return new Response(
+    rows.map(([label, value]) => `${label.padEnd(width)}  ${value}\n`).join(""),
+    { headers: { "content-type": "text/plain" } }
+  );
+}
 
 addEventListener("scheduled", (event) => {
   event.waitUntil(
-    checkAirQuality().then(() => {
+    scheduledCheck(event.scheduledTime).then(() => {
       return flushLogs();
     })
   );
 });
 
-function previousReadings(): Promise<SensorResults | null> {
-  return STATE.get<SensorResults>("last_readings", "json");
+const MIN_CHECK_INTERVAL = 1000 * 60; // 1 minute
+const MAX_CHECK_INTERVAL = 1000 * 60 * 60; // 1 hour
+
+// the cron trigger fires every minute, CHECK_INTERVAL controls how many of
+// those actually end up hitting purple air.
+function checkInterval(): number {
+  const interval = durationVar("CHECK_INTERVAL", MIN_CHECK_INTERVAL);
+  if (interval < MIN_CHECK_INTERVAL || interval % MIN_CHECK_INTERVAL !== 0) {
+    throw new Error("CHECK_INTERVAL must be a whole number of minutes");
+  }
+  if (interval > MAX_CHECK_INTERVAL) {
+    // readings that far apart say little about where the air is heading
+    throw new Error("CHECK_INTERVAL must not be longer than 1h");
+  }
+  return interval;
+}
+
+// stored state outlives CHECK_INTERVAL by this much, so that the next check
+// still finds it however long its jitter and fetch take
+const STATE_TTL_MARGIN = 1000 * 60 * 10; // 10 minutes
+// ...and is kept for at least this long, since an open breaker skips checks
+// (without saving anything) for up to 30m
+const MIN_STATE_TTL = 1000 * 60 * 60; // 1 hour
+
+// stateTTL is how long (in milliseconds) state and last_check are kept for.
+function stateTTL(): number {
+  return Math.max(checkInterval() + STATE_TTL_MARGIN, MIN_STATE_TTL);
+}
+
+async function scheduledCheck(scheduledTime: number): Promise<void> {
+  await applyOverrides();
+  try {
+    const interval = checkInterval();
+    const jitter = checkJitter();
+    logInfo("scheduledCheck", { check_interval_ms: interval });
+    const lastCheck = await STATE.get("last_check");
+    if (lastCheck && scheduledTime - parseInt(lastCheck, 10) < interval) {
+      logInfo("check interval has not elapsed, skipping", { lastCheck });
+      return;
+    }
+    await STATE.put("last_check", String(scheduledTime), {
+      expirationTtl: Math.ceil(stateTTL() / 1000),
+    });
+    const wait = Math.floor(Math.random() * jitter);
+    if (wait > 0) {
+      logInfo("waiting before checking", { jitter_ms: wait });
+      await new Promise((resolve) => setTimeout(resolve, wait));
+    }
+  } catch (e) {
+    logError("failed to schedule air quality check", {
+      error: e.message,
+    });
+    return;
+  }
+  await checkAllLocations();
 }
 
-function storeReadings(r: SensorResults): Promise<void> {
-  return STATE.put("last_readings", JSON.stringify(r), {
-    expirationTtl: 3600, // 1 hour
+// CHECK_JITTER spreads the checks out over the minute, rather than every
+// deployment hitting purple air right as the cron trigger fires. it has to
+// stay under a minute, so that checks don't pile up.
+function checkJitter(): number {
+  const jitter = durationVar("CHECK_JITTER", 0);
+  if (jitter < 0 || jitter >= MIN_CHECK_INTERVAL) {
+    throw new Error("CHECK_JITTER must be less than 1m");
+  }
+  return jitter;
+}
+
+const SENSOR_CONFIG_REFRESH = 1000 * 60 * 60; // 1 hour
+
+// applyOverrides sets the vars that come from elsewhere than wrangler.toml:
+// the sensor config, and then the profile on top of that.
+async function applyOverrides(): Promise<void> {
+  overrideVars({});
+  const sensorConfig = await sensorConfigVars();
+  let profile: Record<string, string> = {};
+  try {
+    profile = (await activeProfile()).vars;
+  } catch (e) {
+    logError("failed to apply the profile", { error: e.message });
+  }
+  overrideVars({ ...sensorConfig, ...profile });
+}
+
+// sensorConfigVars are the sensor ids and thresholds (of the default
+// location) from SENSOR_CONFIG_URL, in place of the ones in wrangler.toml.
+async function sensorConfigVars(): Promise<Record<string, string>> {
+  try {
+    const url = optionalVar("SENSOR_CONFIG_URL");
+    if (!url) {
+      return {};
+    }
+    const vars = await loadSensorConfig(
+      STATE,
+      {
+        url,
+        refresh: durationVar("SENSOR_CONFIG_REFRESH", SENSOR_CONFIG_REFRESH),
+        timeout: durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT),
+        validate: (vars) => {
+          overrideVars(vars);
+          try {
+            aqThresholds();
+          } finally {
+            overrideVars({});
+          }
+        },
+      },
+      Date.now()
+    );
+    return vars || {};
+  } catch (e) {
+    logError("failed to apply the sensor config", { error: e.message });
+    return {};
+  }
+}
+
+// profiles are the builtin profiles, and any of PROFILES. "smoke" makes the
+// air count as bad as soon as it leaves the best category, with reminders
+// coming sooner, for when wildfire smoke is around.
+function profiles(): Profiles {
+  return parseProfiles(optionalVar("PROFILES"), {
+    normal: {},
+    smoke: {
+      AQ_THRESHOLD: airQualityIndex().categories[1],
+      AQ_THRESHOLD_HIGH: "",
+      AQ_THRESHOLD_LOW: "",
+      NOTIFY_COOLDOWN: "10m",
+      ESCALATION_SCHEDULE: "30m,1h",
+    },
   });
 }
 
-const AQ_THRESHOLD = 65;
+// activeProfile is the profile picked through /profile, or else PROFILE
+// (normal, if neither is set).
+async function activeProfile(): Promise<{
+  name: string;
+  source: "runtime" | "PROFILE";
+  vars: Record<string, string>;
+}> {
+  const picked = await loadProfileName(STATE);
+  const name = picked || optionalVar("PROFILE") || "normal";
+  const all = profiles();
+  const vars = Object.keys(all).includes(name) ? all[name] : undefined;
+  if (!vars) {
+    throw new Error(
+      `unknown profile "${name}" (expected one of: ${Object.keys(all).join(
+        ", "
+      )})`
+    );
+  }
+  return { name, source: picked ? "runtime" : "PROFILE", vars };
+}
+
+// locations is every configured LOCATIONS entry, or just the default location
+// when it is not set.
+function locations(): Location[] {
+  const raw = optionalVar("LOCATIONS");
+  return raw ? parseLocations(raw) : [{}];
+}
+
+// findLocation looks up a location by name, defaulting to the first one.
+function findLocation(name: string | null): Location {
+  const all = locations();
+  if (!name) {
+    return all[0];
+  }
+  const location = all.find((l) => l.name === name);
+  if (!location) {
+    throw new Error(`unknown location "${name}"`);
+  }
+  return location;
+}
+
+// each location gets its own check (and state), so that one failing doesn't
+// hold up the others.
+async function checkAllLocations(): Promise<void> {
+  let all: Location[];
+  try {
+    all = locations();
+  } catch (e) {
+    logError("failed to check air quality", {
+      error: e.message,
+    });
+    return;
+  }
+  let concurrency: number;
+  try {
+    concurrency = fetchConcurrency();
+  } catch (e) {
+    logError("failed to check air quality", { error: e.message });
+    return;
+  }
+  // each location has a worker that takes the next one left, until none are
+  let next = 0;
+  const worker = async () => {
+    while (next < all.length) {
+      await checkAirQuality(all[next++]);
+    }
+  };
+  await Promise.all(
+    Array.from({ length: Math.min(concurrency, all.length) }, worker)
+  );
+}
+
+// FETCH_CONCURRENCY is how many LOCATIONS are checked at the same time. each
+// one is on its own FETCH_TIMEOUT, so a slow one only holds up its own worker.
+function fetchConcurrency(): number {
+  const concurrency = numberVar("FETCH_CONCURRENCY", 1);
+  if (!Number.isInteger(concurrency) || concurrency < 1) {
+    throw new Error(
+      `FETCH_CONCURRENCY must be a whole number of at least 1, got ${concurrency}`
+    );
+  }
+  return concurrency;
+}
+
+// air quality turns bad when rising above the high threshold and only turns
+// good again once it drops back down to the low threshold. setting just one of
+// them (or just AQ_THRESHOLD) gives a single threshold. locations with any
+// thresholds of their own use those instead.
+function aqThresholds(location: Location = {}): Thresholds {
+  const index = airQualityIndex();
+  const own = location.thresholds;
+  const raw = own || {
+    threshold: optionalVar("AQ_THRESHOLD"),
+    high: optionalVar("AQ_THRESHOLD_HIGH"),
+    low: optionalVar("AQ_THRESHOLD_LOW"),
+  };
+  const names = own
+    ? {
+        threshold: `threshold of location "${location.name}"`,
+        high: `threshold_high of location "${location.name}"`,
+        low: `threshold_low of location "${location.name}"`,
+      }
+    : {
+        threshold: "AQ_THRESHOLD",
+        high: "AQ_THRESHOLD_HIGH",
+        low: "AQ_THRESHOLD_LOW",
+      };
+  const parse = (name: string, value: string | undefined, fallback: number) =>
+    parseThreshold(index, name, value, fallback);
+  const threshold = parse(
+    names.threshold,
+    raw.threshold,
+    index.defaultThreshold
+  );
+  const high = parse(
+    names.high,
+    raw.high,
+    parse(names.low, raw.low, threshold)
+  );
+  const t: Thresholds = { low: parse(names.low, raw.low, high), high };
+  if (t.low > t.high) {
+    throw new Error(`${names.low} must not be greater than ${names.high}`);
+  }
+  return t;
+}
+
+// thresholds are either a value on the index, or the name of the category at
+// which the air counts as bad (e.g. "unhealthy" is the same as an AQI of 150).
+function parseThreshold(
+  index: AirQualityIndex,
+  name: string,
+  value: string | undefined,
+  fallback: number
+): number {
+  if (value === undefined) {
+    return fallback;
+  }
+  if (!/[a-z]/i.test(value)) {
+    const n = Number(value);
+    if (isNaN(n)) {
+      throw new Error(`invalid number for ${name}: "${value}"`);
+    }
+    return n;
+  }
+  const category = findCategory(index, value);
+  // the best category can't be "bad"
+  if (category === undefined || category === index.categories[0]) {
+    const expected = index.categories.slice(1).map((c) => c.toLowerCase());
+    throw new Error(
+      `invalid category for ${name}: "${value}" (expected one of: ${expected.join(
+        ", "
+      )})`
+    );
+  }
+  return index.floor(category);
+}
+
+// decisionMetric is which reading crosses the thresholds: the 10 minute
+// average (the default), the realtime one (quicker to react, but noisier) or
+// the mean of the two.
+function decisionMetric(): DecisionMetric {
+  const metric = (optionalVar("DECISION_METRIC") || "tenm") as DecisionMetric;
+  if (!DECISION_METRICS.includes(metric)) {
+    throw new Error(
+      `unknown DECISION_METRIC "${metric}" (expected one of: ${DECISION_METRICS.join(
+        ", "
+      )})`
+    );
+  }
+  return metric;
+}
+
+const READINGS_LOG_LIMIT = 60 * 24; // a day's worth of checks, every minute
+
+function breakerConfig(): BreakerConfig {
+  return {
+    threshold: numberVar("BREAKER_THRESHOLD", 5),
+    backoff: durationVar("BREAKER_BACKOFF", 1000 * 60 * 5),
+  };
+}
+
+function readingsLogLimit(): number {
+  const limit = numberVar("READINGS_LOG_LIMIT", READINGS_LOG_LIMIT);
+  if (!Number.isInteger(limit) || limit < 1) {
+    throw new Error("READINGS_LOG_LIMIT must be a positive whole number");
+  }
+  return limit;
+}
 
-async function checkAirQuality(): Promise<void> {
+async function checkAirQuality(location: Location = {}): Promise<void> {
+  // what sentry gets to know about a failure, filled in as the check goes
+  const tags: Record<string, string | undefined> = {
+    location: location.name,
+    sensor_id: (location.sensorIDs || listVar("SENSOR_IDS"))[0],
+  };
   try {
-    logInfo("checkAirQuality");
-    let results = await getSensorData(SENSOR_IDS.split(","));
+    logInfo("checkAirQuality", { location: location.name });
+    const settings = evaluationSettings(location);
+    const { index } = settings;
+    const breaker = breakerConfig();
+    let state = await loadState(STATE, location.name);
+    switch (breakerStatus(state?.breaker, Date.now())) {
+      case "open":
+        logInfo("circuit breaker is open, not fetching", {
+          until: new Date(state?.breaker?.openUntil || 0),
+        });
+        return;
+      case "half-open":
+        logInfo("circuit breaker is half-open, trying to fetch again");
+        break;
+    }
+    let results: SensorResults;
+    try {
+      results = checkReadings(await initSource(location).readings());
+    } catch (e) {
+      await recordFetchError(STATE);
+      if (e instanceof UpstreamSchemaError) {
+        // not going to fix itself, unlike the rest
+        logError("upstream schema may have changed, aqimon needs updating", {
+          location: location.name,
+          error: e.message,
+        });
+      }
+      // a sensor that stopped reporting is no reason to back off from an api
+      // that is answering just fine
+      const stale = e instanceof StaleDataError;
+      await saveState(
+        STATE,
+        {
+          ...state,
+          lastError: {
+            message: e.message,
+            at: Date.now(),
+            kind: e instanceof SourceError ? e.kind : undefined,
+          },
+          breaker: stale
+            ? state?.breaker
+            : breakerFailure(state?.breaker, breaker, Date.now()),
+        },
+        stateTTL(),
+        location.name
+      );
+      throw e;
+    }
+    tags.sensor_id = results.sensorID;
+    if (state) {
+      state.breaker = breakerSuccess(state.breaker);
+    }
+    let flatline: State["flatline"];
+    ({ results, flatline } = await watchFlatline(
+      results,
+      state?.flatline,
+      state?.zone || zoneOf(results, settings),
+      index,
+      location
+    ));
+    const backup = await watchBackup(
+      results,
+      state?.backup,
+      state?.zone || zoneOf(results, settings),
+      index,
+      location
+    );
+    results = await applyRollingAverages(results, index, location.name);
+    if (boolVar("NOWCAST")) {
+      results = await applyNowCast(results, index, location.name);
+    }
     logInfo("current_readings", { ...results });
-    let lastReadings = await previousReadings();
-    await storeReadings(results);
-    if (!lastReadings) {
+    await checkIn();
+    await publishReadings(results, index, location.name);
+    if (boolVar("READINGS_LOG")) {
+      await appendReading(
+        STATE,
+        results,
+        index,
+        readingsLogLimit(),
+        location.name
+      );
+    }
+    if (boolVar("NOTIFY_ON_START")) {
+      await announceStart(
+        results,
+        state?.zone || zoneOf(results, settings),
+        index,
+        location
+      );
+    }
+    const warmup = {
+      build: buildID(),
+      checks:
+        (state?.warmup?.build === buildID() ? state.warmup.checks : 0) + 1,
+    };
+    let lastReadings = state?.lastReadings;
+    if (!state || !lastReadings) {
+      await saveState(
+        STATE,
+        {
+          ...state,
+          lastReadings: results,
+          lastFetch: Date.now(),
+          zone: zoneOf(results, settings),
+          backup,
+          flatline,
+          warmup,
+        },
+        stateTTL(),
+        location.name
+      );
       logInfo("no previous readings stored, nothing to compare");
       return;
     }
+    // a new build holds off until it has WARMUP_CHECKS readings in, so that
+    // one noisy reading right after a deploy doesn't set off an alert. the
+    // zone stays as it was, so the readings after that still get compared to
+    // what was last notified about
+    if (warmup.checks <= warmupChecks()) {
+      await saveState(
+        STATE,
+        {
+          ...state,
+          lastReadings: results,
+          lastFetch: Date.now(),
+          backup,
+          flatline,
+          warmup,
+        },
+        stateTTL(),
+        location.name
+      );
+      logInfo("warming up, not notifying", { checks: warmup.checks });
+      return;
+    }
     logInfo("last_readings", lastReadings);
-    let event: "air_quality_good" | "air_quality_bad";
-    if (
-      lastReadings.tenMinuteAvg > AQ_THRESHOLD &&
-      results.tenMinuteAvg <= AQ_THRESHOLD
-    ) {
-      event = "air_quality_good";
-    } else if (
-      lastReadings.tenMinuteAvg <= AQ_THRESHOLD &&
-      results.tenMinuteAvg > AQ_THRESHOLD
-    ) {
-      event = "air_quality_bad";
-    } else {
-      logInfo("nothing to alert about");
+    const next = evaluate(
+      { ...state, lastReadings },
+      results,
+      Date.now(),
+      settings
+    );
+    const notification = next.notification;
+    await saveState(
+      STATE,
+      { ...next.state, backup, flatline, warmup },
+      stateTTL(),
+      location.name
+    );
+    if (!notification) {
       return;
     }
-    await notify(event, results);
+    tags.event = notification.event;
+    await initNotifier(location.notifiers).notify(notification);
+    await recordNotification(STATE, notification.event);
   } catch (e) {
     logError("failed to check air quality", {
+      location: location.name,
       error: e.message,
     });
+    await reportError(e, tags);
+    return;
+  }
+}
+
+// Settings is everything evaluate goes by, besides the state.
+function evaluationSettings(location: Location): Settings {
+  return {
+    location,
+    index: airQualityIndex(),
+    precision: aqiPrecision(),
+    thresholds: aqThresholds(location),
+    decision: decisionMetric(),
+    templates: messageTemplates(),
+    schedule: escalationSchedule(),
+    cooldown: durationVar("NOTIFY_COOLDOWN", 0),
+    quiet: quietHours(),
+    noteBackup: boolVar("NOTE_BACKUP"),
+  };
+}
+
+const FLATLINE_ACTIONS = ["warn", "notify", "backup"];
+
+// watchFlatline counts the checks in a row that the sensor has reported the
+// very same reading, which usually means it is stuck rather than the air
+// being that still. from FLATLINE_CHECKS of them on, it warns, and depending
+// on FLATLINE_ACTION sends a one-off notification, or reads from the backup
+// sensors instead (the stuck one is still read every check, to see whether it
+// has come unstuck).
+async function watchFlatline(
+  results: SensorResults,
+  flatline: State["flatline"],
+  zone: AirQualityZone,
+  index: AirQualityIndex,
+  location: Location
+): Promise<{ results: SensorResults; flatline: State["flatline"] }> {
+  const checks = numberVar("FLATLINE_CHECKS", 0);
+  if (checks <= 0) {
+    return { results, flatline: undefined };
+  }
+  const action = optionalVar("FLATLINE_ACTION") || "warn";
+  if (!FLATLINE_ACTIONS.includes(action)) {
+    throw new Error(
+      `unknown FLATLINE_ACTION "${action}" (expected one of: ${FLATLINE_ACTIONS.join(
+        ", "
+      )})`
+    );
+  }
+  const value = results.pm25Realtime ?? results.realtime;
+  if (flatline?.sensorID !== results.sensorID || flatline?.value !== value) {
+    if (flatline && flatline.count >= checks) {
+      logInfo("sensor is no longer stuck", { sensorID: flatline.sensorID });
+    }
+    flatline = { sensorID: results.sensorID, value, count: 1 };
+    return { results, flatline };
+  }
+  flatline = { ...flatline, count: flatline.count + 1 };
+  if (flatline.count < checks) {
+    return { results, flatline };
+  }
+  logWarn("sensor seems stuck, reporting the same reading every check", {
+    sensorID: results.sensorID,
+    value,
+    checks: flatline.count,
+  });
+  if (action === "backup") {
+    if (!results.sensorID) {
+      return { results, flatline };
+    }
+    try {
+      const backup = await initSource(location, [results.sensorID]).readings();
+      if (backup.sensorID === results.sensorID) {
+        // e.g. the local sensor, which doesn't go by the sensor ids
+        throw new Error("the stuck sensor is the only one there is");
+      }
+      return { results: { ...backup, backup: true }, flatline };
+    } catch (e) {
+      logWarn("no backup sensor to use instead of the stuck one", {
+        error: e.message,
+      });
+      return { results, flatline };
+    }
+  }
+  if (action !== "notify" || flatline.alerted) {
+    return { results, flatline };
+  }
+  const category = index.category(results.tenMinuteAvg);
+  const sensor = results.sensorID
+    ? `sensor ${results.sensorID}`
+    : "the sensor";
+  const message = `⚠️ ${sensor} seems stuck, it has reported exactly the same reading for the last ${flatline.count} checks (${index.name} ${roundAQI(
+    results.tenMinuteAvg,
+    aqiPrecision()
+  )}, ${category})`;
+  const alerted = { ...flatline, alerted: true };
+  await sendNotice(
+    "flatline",
+    () => {
+      flatline = alerted;
+    },
+    message,
+    results,
+    zone,
+    index,
+    location
+  );
+  return { results, flatline };
+}
+
+// watchBackup keeps track of how long the readings have been coming from a
+// backup sensor, and sends a one-off notification about it once that has gone
+// on for BACKUP_ALERT_AFTER.
+async function watchBackup(
+  results: SensorResults,
+  backup: State["backup"],
+  zone: AirQualityZone,
+  index: AirQualityIndex,
+  location: Location
+): Promise<State["backup"]> {
+  if (!results.backup) {
+    if (backup) {
+      logInfo("primary sensor is back", { since: new Date(backup.since) });
+    }
+    return undefined;
+  }
+  backup = backup || { since: Date.now() };
+  const after = durationVar("BACKUP_ALERT_AFTER", 0);
+  if (after <= 0 || backup.alerted || Date.now() - backup.since < after) {
+    return backup;
+  }
+  const category = index.category(results.tenMinuteAvg);
+  const minutes = Math.round((Date.now() - backup.since) / (1000 * 60));
+  const message = `⚠️ the primary sensor has been down for ${minutes}m, using backup sensor ${results.sensorID} (${index.name} ${roundAQI(
+    results.tenMinuteAvg,
+    aqiPrecision()
+  )}, ${category})`;
+  const alerted = { ...backup, alerted: true };
+  await sendNotice(
+    "primary_down",
+    () => {
+      backup = alerted;
+    },
+    message,
+    results,
+    zone,
+    index,
+    location
+  );
+  return backup;
+}
+
+// buildID tells builds apart, even ones that share a version (e.g. "dev").
+function buildID(): string {
+  return `${buildInfo.version}/${buildInfo.commit}/${buildInfo.buildDate}`;
+}
+
+// warmupChecks is how many readings a new build takes (and stores) before it
+// may notify, 0 (the default) to notify straight away.
+function warmupChecks(): number {
+  const checks = numberVar("WARMUP_CHECKS", 0);
+  if (!Number.isInteger(checks) || checks < 0) {
+    throw new Error(`WARMUP_CHECKS must be a whole number, got ${checks}`);
+  }
+  return checks;
+}
+
+// announceStart sends a one-off notification that the monitor is up, with the
+// readings it sees, the first time each build checks a location.
+async function announceStart(
+  results: SensorResults,
+  zone: AirQualityZone,
+  index: AirQualityIndex,
+  location: Location
+): Promise<void> {
+  const key = locationKey("started", location.name);
+  const build = buildID();
+  if ((await STATE.get(key)) === build) {
     return;
   }
+  const category = index.category(results.tenMinuteAvg);
+  const message = `🟢 aqimon ${buildInfo.version} started, current ${
+    index.name
+  } is ${roundAQI(results.tenMinuteAvg, aqiPrecision())} (${category})`;
+  await sendNotice(
+    "startup",
+    () => STATE.put(key, build),
+    message,
+    results,
+    zone,
+    index,
+    location
+  );
 }
 
-function roundToDecimal(x: number, precision: number): number {
-  let pow10 = Math.pow(10, precision);
-  return Math.round(x * pow10) / pow10;
+// sendNotice marks a one-off notice as sent with mark, then sends message to
+// the location's notifiers, reporting (rather than throwing) any failure.
+async function sendNotice(
+  kind: Notice,
+  mark: () => void | Promise<void>,
+  message: string,
+  results: SensorResults,
+  zone: AirQualityZone,
+  index: AirQualityIndex,
+  location: Location
+): Promise<void> {
+  // marked first, so that a failing notifier doesn't repeat it every check
+  await mark();
+  if (location.name) {
+    message = `[${location.name}] ${message}`;
+  }
+  const category = index.category(results.tenMinuteAvg);
+  try {
+    await initNotifier(location.notifiers).notify({
+      event: zone === "bad" ? "air_quality_bad" : "air_quality_good",
+      readings: results,
+      category,
+      previousCategory: category,
+      index: index.name,
+      precision: aqiPrecision(),
+      location: location.name,
+      message,
+      startup: kind === "startup",
+      primaryDown: kind === "primary_down",
+      flatline: kind === "flatline",
+    });
+  } catch (e) {
+    logError("failed to send notice", { notice: kind, error: e.message });
+    await reportError(e, {
+      location: location.name,
+      sensor_id: results.sensorID,
+      event: kind,
+    });
+  }
 }
 
-async function notify(
-  event: "air_quality_good" | "air_quality_bad",
-  readings: SensorResults
+const MAX_ROLLING_WINDOW = 1000 * 60 * 60 * 6; // 6 hours
+
+// applyRollingAverages replaces the realtime reading and the 10 minute average
+// with averages of the last ROLLING_WINDOW_RT and ROLLING_WINDOW worth of
+// realtime readings (kept in kv), for when purpleair's own averages lag.
+async function applyRollingAverages(
+  results: SensorResults,
+  index: AirQualityIndex,
+  location?: string
+): Promise<SensorResults> {
+  const rtWindow = durationVar("ROLLING_WINDOW_RT", 0);
+  const window = durationVar("ROLLING_WINDOW", 0);
+  if (rtWindow <= 0 && window <= 0) {
+    return results;
+  }
+  for (let [name, w] of [
+    ["ROLLING_WINDOW_RT", rtWindow],
+    ["ROLLING_WINDOW", window],
+  ] as const) {
+    if (w > MAX_ROLLING_WINDOW) {
+      throw new Error(`${name} must not be longer than 6h`);
+    }
+  }
+  if (window > 0 && boolVar("NOWCAST")) {
+    throw new Error("ROLLING_WINDOW and NOWCAST can't be used together");
+  }
+  if (results.pm25Realtime === undefined) {
+    return results;
+  }
+  const now = Date.now();
+  const samples = await recordSample(
+    STATE,
+    results.pm25Realtime,
+    now,
+    Math.max(rtWindow, window),
+    location
+  );
+  // pm10 is not averaged, so when it is what the readings come down to they
+  // are left as they are
+  const averaged = (current: number, w: number) => {
+    if (w <= 0) {
+      return current;
+    }
+    const aqi = index.fromPM(rollingAverage(samples, w, now));
+    return results.dominantPollutant === "pm10" && current > aqi
+      ? current
+      : aqi;
+  };
+  logInfo("rolling averages", { samples: samples.length });
+  return {
+    ...results,
+    realtime: averaged(results.realtime, rtWindow),
+    tenMinuteAvg: averaged(results.tenMinuteAvg, window),
+  };
+}
+
+// applyNowCast replaces the 10 minute average with the EPA's NowCast of the
+// hourly PM2.5 averages, once there are enough of them. sources without PM2.5
+// readings (e.g. AirNow, which already reports NowCast) are left alone.
+async function applyNowCast(
+  results: SensorResults,
+  index: AirQualityIndex,
+  location?: string
+): Promise<SensorResults> {
+  if (results.pm25 === undefined) {
+    return results;
+  }
+  const hourly = await recordHourlyPM(
+    STATE,
+    results.pm25,
+    Date.now(),
+    location
+  );
+  const pm = nowCast(hourly);
+  if (isNaN(pm)) {
+    logInfo("not enough hourly readings for nowcast yet");
+    return results;
+  }
+  const aqi = index.fromPM(pm);
+  if (results.dominantPollutant === "pm10" && results.tenMinuteAvg > aqi) {
+    return results;
+  }
+  return {
+    ...results,
+    tenMinuteAvg: aqi,
+    dominantPollutant: results.dominantPollutant && "pm2.5",
+  };
+}
+
+// publishReadings sends every reading (not just the ones worth notifying
+// about) to a prometheus pushgateway and to MQTT, when they are configured. it
+// is best effort, so failures are only logged.
+async function publishReadings(
+  results: SensorResults,
+  index: AirQualityIndex,
+  location?: string
 ): Promise<void> {
-  let message = "";
-  switch (event) {
-    case "air_quality_good":
-      message =
-        "📉👍 Nearby air quality seems to be getting better. Open windows for fresh air.";
-      break;
-    case "air_quality_bad":
-      message =
-        "📈👎 Nearby air quality is getting bad. Close any open windows.";
-      break;
-  }
-  message += "\n";
-  message += `(avg10_pm2.5: ${roundToDecimal(
-    readings.tenMinuteAvg,
-    0
-  )}, rt_pm2.5: ${roundToDecimal(readings.realtime, 0)})`;
-
-  let allURLParams = new URLSearchParams();
-  allURLParams.set("Body", message);
-  allURLParams.set("From", TWILIO_FROM);
-  for (let phoneNumber of SMS_RECIPIENTS.split(",").map((s) => s.trim())) {
-    let urlParams = new URLSearchParams(allURLParams);
-    urlParams.set("To", phoneNumber);
-    let response = await fetch(
-      `https://api.twilio.com/2010-04-01/Accounts/${TWILIO_ACCOUNT_SID}/Messages.json`,
-      {
-        method: "POST",
-        headers: {
-          "user-agent": "github.com/nkcmr/aqimon",
-          "content-type": "application/x-www-form-urlencoded",
-          accept: "application/json",
-          authorization: twilioAuthHeader(),
+  const pushgateway = optionalVar("PUSHGATEWAY_URL");
+  if (pushgateway) {
+    try {
+      await pushReadings(
+        {
+          url: pushgateway,
+          username: optionalVar("PUSHGATEWAY_USER"),
+          password: optionalVar("PUSHGATEWAY_PASS"),
+          timeout: durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT),
+          precision: aqiPrecision(),
         },
-        body: urlParams.toString(),
-      }
+        results,
+        location
+      );
+    } catch (e) {
+      logWarn("failed to push readings to the pushgateway", {
+        error: e.message,
+      });
+    }
+  }
+  const broker = optionalVar("MQTT_BROKER");
+  if (!broker) {
+    return;
+  }
+  try {
+    await new MQTTPublisher({
+      broker,
+      username: optionalVar("MQTT_USER"),
+      password: optionalVar("MQTT_PASS"),
+      discoveryPrefix: optionalVar("MQTT_DISCOVERY_PREFIX") || "homeassistant",
+      topicPrefix: optionalVar("MQTT_TOPIC_PREFIX") || "aqimon",
+      location,
+      index,
+      precision: aqiPrecision(),
+    }).publish(results);
+  } catch (e) {
+    logWarn("failed to publish readings to mqtt", { error: e.message });
+  }
+}
+
+const SNITCHED_KEY = "snitched_at";
+
+// checkIn pings DEADMAN_SNITCH (e.g. a https://deadmanssnitch.com or
+// healthchecks.io url) after readings are fetched, at most once per
+// SNITCH_INTERVAL, so that something notices when the checks stop working.
+async function checkIn(): Promise<void> {
+  const url = optionalVar("DEADMAN_SNITCH");
+  if (!url) {
+    return;
+  }
+  const interval = durationVar("SNITCH_INTERVAL", 0);
+  const last = Number((await STATE.get(SNITCHED_KEY)) || 0);
+  if (Date.now() - last < interval) {
+    return;
+  }
+  try {
+    const response = await fetchWithTimeout(
+      url,
+      { headers: { "user-agent": userAgent() } },
+      durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT)
     );
+    await response.body?.cancel();
     if (!response.ok) {
-      logError(`non-ok response body`, { body: await response.text() });
+      throw new Error(`non-ok status returned (${response.status})`);
+    }
+  } catch (e) {
+    // only the host is logged, the rest of the url is the secret
+    logWarn("failed to check in with the snitch", {
+      host: new URL(url).host,
+      error: e.message,
+    });
+    return;
+  }
+  await STATE.put(SNITCHED_KEY, String(Date.now()));
+}
+
+const TEMPLATE_VARS: Record<AirQualityEvent, string> = {
+  air_quality_bad: "TEMPLATE_BAD",
+  air_quality_good: "TEMPLATE_GOOD",
+  air_quality_worse: "TEMPLATE_WORSE",
+  air_quality_better: "TEMPLATE_BETTER",
+  air_quality_still_bad: "TEMPLATE_STILL_BAD",
+};
+
+function messageTemplates(): Partial<Record<AirQualityEvent, MessageTemplate>> {
+  const timeZone = optionalVar("TIMEZONE") || "UTC";
+  const templates: Partial<Record<AirQualityEvent, MessageTemplate>> = {};
+  for (let [event, name] of Object.entries(TEMPLATE_VARS)) {
+    const source = optionalVar(name);
+    if (!source) {
+      continue;
+    }
+    try {
+      templates[event as AirQualityEvent] = new MessageTemplate(
+        source,
+        timeZone
+      );
+    } catch (e) {
+      throw new Error(`invalid ${name}: ${e.message}`);
+    }
+  }
+  return templates;
+}
+
+// escalationSchedule is the list of intervals between reminders that the air
+// is still bad, e.g. "1h,2h,4h". empty unless ESCALATION_SCHEDULE is set.
+function escalationSchedule(): number[] {
+  return listVar("ESCALATION_SCHEDULE").map((s) => {
+    const d = parseDuration(s);
+    if (isNaN(d) || d <= 0) {
+      throw new Error(`invalid duration in ESCALATION_SCHEDULE: "${s}"`);
+    }
+    return d;
+  });
+}
+
+function quietHours(): QuietHours | null {
+  const start = optionalVar("QUIET_START");
+  const end = optionalVar("QUIET_END");
+  if (!start || !end) {
+    return null;
+  }
+  const mode = optionalVar("QUIET_MODE") || "drop";
+  if (mode !== "drop" && mode !== "defer") {
+    throw new Error(
+      `unknown QUIET_MODE "${mode}" (expected "drop" or "defer")`
+    );
+  }
+  return new QuietHours(start, end, optionalVar("TIMEZONE") || "UTC", mode);
+}
+
+// sensors in exclude are left out of the purpleair sensor ids.
+function initSource(
+  location: Location = {},
+  exclude: string[] = []
+): SensorSource {
+  const source = optionalVar("SOURCE") || "purpleair";
+  if (location.sensorIDs && source !== "purpleair") {
+    throw new Error("LOCATIONS is only supported by the purpleair source");
+  }
+  switch (source) {
+    case "purpleair": {
+      const options = purpleAirOptions();
+      // primary sensors first, then backups, each tried only once
+      const sensorIDs = [
+        ...new Set(
+          location.sensorIDs || [
+            ...listVar("SENSOR_IDS"),
+            ...listVar("BACKUP_SENSOR_IDS"),
+          ]
+        ),
+      ].filter((id) => !exclude.includes(id));
+      // the local sensor belongs to the default location
+      const localURL = location.sensorIDs
+        ? undefined
+        : optionalVar("LOCAL_SENSOR_URL");
+      // so does the group, which replaces SENSOR_IDS
+      const groupID = location.sensorIDs
+        ? undefined
+        : optionalVar("PURPLE_AIR_GROUP_ID");
+      let cloud: SensorSource | null = null;
+      if (groupID) {
+        cloud = new PurpleAirGroupSource(
+          groupID,
+          aggregateVar("GROUP_AGGREGATE"),
+          options
+        );
+      } else if (sensorIDs.length > 0) {
+        cloud = new PurpleAirSource(sensorIDs, options);
+      }
+      if (localURL) {
+        return new LocalPurpleAirSource(
+          {
+            url: localURL,
+            timeout: localSensorTimeout(),
+          },
+          options,
+          cloud
+        );
+      }
+      if (!cloud) {
+        throw new Error(
+          "SENSOR_IDS or PURPLE_AIR_GROUP_ID is required for the purpleair source"
+        );
+      }
+      return cloud;
+    }
+    case "airnow": {
+      if (airQualityIndex() !== US_AQI) {
+        // airnow only reports the AQI, not the concentrations behind it
+        throw new Error("the airnow source only supports INDEX aqi");
+      }
+      const apiKey = optionalVar("AIRNOW_API_KEY");
+      const latitude = numberVar("AIRNOW_LATITUDE", NaN);
+      const longitude = numberVar("AIRNOW_LONGITUDE", NaN);
+      if (!apiKey || isNaN(latitude) || isNaN(longitude)) {
+        throw new Error(
+          "AIRNOW_API_KEY, AIRNOW_LATITUDE and AIRNOW_LONGITUDE are required for the airnow source"
+        );
+      }
+      return new AirNowSource({
+        apiKey,
+        latitude,
+        longitude,
+        distance: numberVar("AIRNOW_DISTANCE", 25),
+        retry: retryPolicy(),
+      });
+    }
+    case "aqicn": {
+      if (airQualityIndex() !== US_AQI) {
+        // so does aqicn
+        throw new Error("the aqicn source only supports INDEX aqi");
+      }
+      const token = optionalVar("AQICN_TOKEN");
+      const station = optionalVar("AQICN_STATION");
+      const latitude = numberVar("AQICN_LATITUDE", NaN);
+      const longitude = numberVar("AQICN_LONGITUDE", NaN);
+      if (!token || (!station && (isNaN(latitude) || isNaN(longitude)))) {
+        throw new Error(
+          "AQICN_TOKEN and either AQICN_STATION or AQICN_LATITUDE and AQICN_LONGITUDE are required for the aqicn source"
+        );
+      }
+      return new AQICNSource({
+        token,
+        station,
+        latitude,
+        longitude,
+        retry: retryPolicy(),
+      });
+    }
+  }
+  throw new Error(
+    `unknown SOURCE "${source}" (expected "purpleair", "airnow" or "aqicn")`
+  );
+}
+
+function purpleAirOptions(): PurpleAirOptions {
+  const apiKey = optionalVar("PURPLE_AIR_API_KEY");
+  const api = optionalVar("PURPLE_AIR_API") || (apiKey ? "v1" : "legacy");
+  if (api !== "legacy" && api !== "v1") {
+    throw new Error(
+      `unknown PURPLE_AIR_API "${api}" (expected "legacy" or "v1")`
+    );
+  }
+  if (api === "v1" && !apiKey) {
+    throw new Error("PURPLE_AIR_API_KEY is required to use the v1 api");
+  }
+  return {
+    api,
+    apiKey,
+    epaCorrection: boolVar("EPA_CORRECTION"),
+    aggregate: aggregateVar("AGGREGATE"),
+    includePM10: boolVar("INCLUDE_PM10"),
+    retry: retryPolicy(),
+    maxDivergence: numberVar("CHANNEL_MAX_DIVERGENCE", 0),
+    index: airQualityIndex(),
+    cacheTTL: durationVar("CACHE_TTL", 0),
+    maxPM: numberVar("MAX_PM", 0),
+  };
+}
+
+function aggregateVar(name: string): Aggregate {
+  const aggregate = optionalVar(name) || "mean";
+  if (!AGGREGATES.hasOwnProperty(aggregate)) {
+    throw new Error(
+      `unknown ${name} "${aggregate}" (expected one of: ${Object.keys(
+        AGGREGATES
+      ).join(", ")})`
+    );
+  }
+  return AGGREGATES[aggregate];
+}
+
+function airQualityIndex(): AirQualityIndex {
+  const index = optionalVar("INDEX") || "aqi";
+  if (!INDICES.hasOwnProperty(index)) {
+    throw new Error(
+      `unknown INDEX "${index}" (expected one of: ${Object.keys(INDICES).join(
+        ", "
+      )})`
+    );
+  }
+  return INDICES[index];
+}
+
+// reportError sends an error to sentry, when SENTRY_DSN is set. failing to do
+// so is only logged, so that it doesn't get in the way of the check.
+async function reportError(
+  error: Error,
+  tags: Record<string, string | undefined>
+): Promise<void> {
+  const dsn = optionalVar("SENTRY_DSN");
+  if (!dsn) {
+    return;
+  }
+  try {
+    await captureError(
+      {
+        dsn,
+        version: buildInfo.version,
+        timeout: durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT),
+      },
+      error,
+      tags
+    );
+  } catch (e) {
+    logWarn("failed to report error to sentry", { error: e.message });
+  }
+}
+
+// aqiPrecision is how many decimal places reported index values are rounded
+// to (the categories are still told by the whole number).
+function aqiPrecision(): number {
+  const digits = numberVar("AQI_PRECISION", 0);
+  if (!Number.isInteger(digits) || digits < 0 || digits > 3) {
+    throw new Error(
+      `AQI_PRECISION must be a whole number from 0 to 3, got ${digits}`
+    );
+  }
+  return digits;
+}
+
+const FETCH_TIMEOUT = 1000 * 10; // 10 seconds, for each attempt
+const NOTIFY_TIMEOUT = 1000 * 30; // 30 seconds, for each notifier
+
+function retryPolicy(): RetryPolicy {
+  const retries = numberVar("HTTP_RETRIES", 0);
+  if (!Number.isInteger(retries) || retries < 0) {
+    throw new Error(`HTTP_RETRIES must be a whole number, got ${retries}`);
+  }
+  const waitMin = durationVar("HTTP_RETRY_WAIT_MIN", 1000);
+  const waitMax = durationVar("HTTP_RETRY_WAIT_MAX", 1000 * 10);
+  if (waitMin > waitMax) {
+    throw new Error(
+      "HTTP_RETRY_WAIT_MIN must not be greater than HTTP_RETRY_WAIT_MAX"
+    );
+  }
+  return {
+    retries,
+    waitMin,
+    waitMax,
+    timeout: durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT),
+  };
+}
+
+// initNotifier builds every configured notifier, or just the ones named in
+// only (for locations that route their notifications).
+function initNotifier(only?: string[]): Notifier {
+  const notifiers = configuredNotifiers();
+  if (notifiers.length === 0) {
+    throw new Error("no notifiers are configured");
+  }
+  const timeout = durationVar("NOTIFY_TIMEOUT", NOTIFY_TIMEOUT);
+  if (!only) {
+    return new MultiNotifier(
+      notifiers.map(([, notifier]) => notifier),
+      timeout
+    );
+  }
+  const configured = notifiers.map(([name]) => name);
+  for (let name of only) {
+    if (!configured.includes(name)) {
       throw new Error(
-        `non-ok status returned from twilio (${response.statusText})`
+        `notifier "${name}" is not configured (configured: ${configured.join(
+          ", "
+        )})`
       );
     }
   }
+  return new MultiNotifier(
+    notifiers
+      .filter(([name]) => only.includes(name))
+      .map(([, notifier]) => notifier),
+    timeout
+  );
 }
 
-function twilioAuthHeader(): string {
-  return `Basic ${Buffer.from(
-    `${TWILIO_ACCOUNT_SID}:${TWILIO_AUTH_TOKEN}`
-  ).toString("base64")}`;
+// webhookClientCert is the WEBHOOK_MTLS binding (an mtls certificate uploaded
+// with wrangler), for webhooks that require a client certificate.
+function webhookClientCert(): Fetcher | undefined {
+  const cert = optionalBinding<Fetcher>("WEBHOOK_MTLS");
+  if (cert && typeof cert.fetch !== "function") {
+    throw new Error("WEBHOOK_MTLS must be an mtls_certificates binding");
+  }
+  return cert;
+}
+
+// localSensorTimeout is LOCAL_SENSOR_TIMEOUT, bounded by FETCH_TIMEOUT like
+// every other request (so it can only be used to give up on the local sensor
+// sooner).
+function localSensorTimeout(): number {
+  const local = durationVar("LOCAL_SENSOR_TIMEOUT", 1000 * 5);
+  const bound = durationVar("FETCH_TIMEOUT", FETCH_TIMEOUT);
+  if (local <= 0 || bound <= 0) {
+    return Math.max(local, bound);
+  }
+  return Math.min(local, bound);
+}
+
+// smsMaxSegments is how many segments an sms may take, 0 for no limit.
+function smsMaxSegments(): number {
+  const segments = numberVar("SMS_MAX_SEGMENTS", 0);
+  if (!Number.isInteger(segments) || segments < 0) {
+    throw new Error(`SMS_MAX_SEGMENTS must be a whole number, got ${segments}`);
+  }
+  return segments;
+}
+
+// configuredNotifiers builds every notifier that has its vars set, along with
+// the name LOCATIONS refers to it by.
+function configuredNotifiers(): [string, Notifier][] {
+  const notifiers: [string, Notifier][] = [];
+  const twilioAccountSID = optionalVar("TWILIO_ACCOUNT_SID");
+  const twilioAuthToken = optionalVar("TWILIO_AUTH_TOKEN");
+  const twilioFrom = optionalVar("TWILIO_FROM");
+  const twilioMessagingServiceSID = optionalVar("TWILIO_MESSAGING_SERVICE_SID");
+  const smsRecipients = parseRecipients(listVar("SMS_RECIPIENTS"));
+  if (
+    twilioAccountSID &&
+    twilioAuthToken &&
+    (twilioFrom || twilioMessagingServiceSID) &&
+    smsRecipients.length > 0
+  ) {
+    notifiers.push([
+      "sms",
+      new SMSNotifier({
+        accountSID: twilioAccountSID,
+        authToken: twilioAuthToken,
+        from: twilioFrom,
+        messagingServiceSID: twilioMessagingServiceSID,
+        recipients: smsRecipients,
+        whatsapp: boolVar("TWILIO_WHATSAPP"),
+        statusCallback: optionalVar("TWILIO_STATUS_CALLBACK"),
+        maxSegments: smsMaxSegments(),
+        truncate: boolVar("SMS_TRUNCATE"),
+      }),
+    ]);
+  }
+  const telegramBotToken = optionalVar("TELEGRAM_BOT_TOKEN");
+  const telegramChatID = optionalVar("TELEGRAM_CHAT_ID");
+  if (telegramBotToken && telegramChatID) {
+    notifiers.push([
+      "telegram",
+      new TelegramNotifier({
+        botToken: telegramBotToken,
+        chatID: telegramChatID,
+      }),
+    ]);
+  }
+  const ntfyTopic = optionalVar("NTFY_TOPIC");
+  if (ntfyTopic) {
+    notifiers.push([
+      "ntfy",
+      new NtfyNotifier({
+        server: optionalVar("NTFY_SERVER") || "https://ntfy.sh",
+        topic: ntfyTopic,
+        token: optionalVar("NTFY_TOKEN"),
+      }),
+    ]);
+  }
+  const matrixHomeserver = optionalVar("MATRIX_HOMESERVER");
+  const matrixToken = optionalVar("MATRIX_TOKEN");
+  const matrixRoomID = optionalVar("MATRIX_ROOM_ID");
+  if (matrixHomeserver && matrixToken && matrixRoomID) {
+    notifiers.push([
+      "matrix",
+      new MatrixNotifier({
+        homeserver: matrixHomeserver,
+        token: matrixToken,
+        roomID: matrixRoomID,
+        // the whole notification, retries and all, gets NOTIFY_TIMEOUT
+        retry: { ...retryPolicy(), timeout: 0 },
+      }),
+    ]);
+  }
+  const slackWebhookURL = optionalVar("SLACK_WEBHOOK_URL");
+  if (slackWebhookURL) {
+    notifiers.push([
+      "slack",
+      new SlackNotifier({
+        webhookURL: slackWebhookURL,
+        interactive: !!optionalVar("SLACK_SIGNING_SECRET"),
+      }),
+    ]);
+  }
+  const pagerDutyRoutingKey = optionalVar("PAGERDUTY_ROUTING_KEY");
+  if (pagerDutyRoutingKey) {
+    notifiers.push([
+      "pagerduty",
+      new PagerDutyNotifier({ routingKey: pagerDutyRoutingKey }),
+    ]);
+  }
+  const pushoverToken = optionalVar("PUSHOVER_TOKEN");
+  const pushoverUser = optionalVar("PUSHOVER_USER");
+  if (pushoverToken && pushoverUser) {
+    notifiers.push([
+      "pushover",
+      new PushoverNotifier({ token: pushoverToken, user: pushoverUser }),
+    ]);
+  }
+  const webhookURL = optionalVar("WEBHOOK_URL");
+  if (webhookURL) {
+    notifiers.push([
+      "webhook",
+      new WebhookNotifier({
+        url: webhookURL,
+        secret: optionalVar("WEBHOOK_SECRET"),
+        clientCert: webhookClientCert(),
+      }),
+    ]);
+  }
+  const iftttKey = optionalVar("IFTTT_KEY");
+  if (iftttKey) {
+    notifiers.push([
+      "ifttt",
+      new IFTTTNotifier({
+        key: iftttKey,
+        eventNames: {
+          air_quality_good: optionalVar("IFTTT_EVENT_GOOD"),
+          air_quality_bad: optionalVar("IFTTT_EVENT_BAD"),
+          air_quality_worse: optionalVar("IFTTT_EVENT_WORSE"),
+          air_quality_better: optionalVar("IFTTT_EVENT_BETTER"),
+          air_quality_still_bad: optionalVar("IFTTT_EVENT_STILL_BAD"),
+        },
+      }),
+    ]);
+  }
+  const snsTopicARN = optionalVar("SNS_TOPIC_ARN");
+  if (snsTopicARN) {
+    const accessKeyID = optionalVar("AWS_ACCESS_KEY_ID");
+    const secretAccessKey = optionalVar("AWS_SECRET_ACCESS_KEY");
+    if (!accessKeyID || !secretAccessKey) {
+      throw new Error(
+        "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for SNS_TOPIC_ARN"
+      );
+    }
+    notifiers.push([
+      "sns",
+      new SNSNotifier({
+        topicARN: snsTopicARN,
+        region: optionalVar("AWS_REGION"),
+        credentials: {
+          accessKeyID,
+          secretAccessKey,
+          sessionToken: optionalVar("AWS_SESSION_TOKEN"),
+        },
+      }),
+    ]);
+  }
+  return notifiers;
 }
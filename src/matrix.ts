@@ -0,0 +1,76 @@
+import { fetchWithRetry, RetryPolicy } from "./http";
+import { composeMessage, Notification, Notifier } from "./notifier";
+import { userAgent } from "./version";
+
+export type MatrixConfig = {
+  homeserver: string; // e.g. https://matrix.org
+  token: string; // access token of the account sending the messages
+  roomID: string; // e.g. !abcdefg:matrix.org
+  retry: RetryPolicy;
+};
+
+export class MatrixNotifier implements Notifier {
+  constructor(private config: MatrixConfig) {
+    if (!/^!.+:.+$/.test(config.roomID)) {
+      throw new Error(
+        `invalid MATRIX_ROOM_ID "${config.roomID}" (expected e.g. !abcdefg:matrix.org)`
+      );
+    }
+  }
+
+  async notify(n: Notification): Promise<void> {
+    const message = composeMessage(n);
+    const [headline, ...rest] = message.split("\n");
+    // the transaction id is what lets the homeserver recognize a retried
+    // request as one it already has, rather than posting the message twice
+    const txnID = `aqimon-${Date.now()}-${Math.random().toString(36).slice(2)}`;
+    const url = `${this.config.homeserver.replace(
+      /\/+$/,
+      ""
+    )}/_matrix/client/v3/rooms/${encodeURIComponent(
+      this.config.roomID
+    )}/send/m.room.message/${txnID}`;
+    let response = await fetchWithRetry(
+      url,
+      {
+        method: "PUT",
+        headers: {
+          "user-agent": userAgent(),
+          "content-type": "application/json",
+          authorization: `Bearer ${this.config.token}`,
+        },
+        body: JSON.stringify({
+          msgtype: "m.text",
+          body: message,
+          format: "org.matrix.custom.html",
+          formatted_body: [`<strong>${escapeHTML(headline)}</strong>`]
+            .concat(rest.map(escapeHTML))
+            .join("<br>"),
+        }),
+      },
+      this.config.retry
+    );
+    if (!response.ok) {
+      const body = (await response.json().catch(() => ({}))) as MatrixError;
+      throw new Error(
+        `non-ok status returned from matrix (${response.status}): ${
+          body.error || response.statusText
+        }`
+      );
+    }
+  }
+}
+
+function escapeHTML(s: string): string {
+  return s
+    .replace(/&/g, "&amp;")
+    .replace(/</g, "&lt;")
+    .replace(/>/g, "&gt;")
+    .replace(/"/g, "&quot;");
+}
+
+// https://spec.matrix.org/v1.8/client-server-api/#standard-error-response
+interface MatrixError {
+  errcode?: string;
+  error?: string;
+}
@@ -0,0 +1,162 @@
+import { roundAQI, roundReadings } from "./aqi";
+import { fetchWithTimeout } from "./http";
+import { AirQualityEvent } from "./notifier";
+import { SensorResults } from "./purpleAir";
+import { State } from "./state";
+import { userAgent } from "./version";
+
+const METRICS_KEY = "metrics";
+
+type Counters = {
+  notificationsSent: Partial<Record<AirQualityEvent, number>>;
+  fetchErrors: number;
+  // final statuses twilio reported back (delivered, undelivered or failed)
+  smsStatuses?: Record<string, number>;
+};
+
+async function loadCounters(kv: KVNamespace): Promise<Counters> {
+  const counters = await kv
+    .get<Counters>(METRICS_KEY, "json")
+    .catch(() => null);
+  return counters || { notificationsSent: {}, fetchErrors: 0 };
+}
+
+export async function recordNotification(
+  kv: KVNamespace,
+  event: AirQualityEvent
+): Promise<void> {
+  const counters = await loadCounters(kv);
+  counters.notificationsSent[event] =
+    (counters.notificationsSent[event] || 0) + 1;
+  await kv.put(METRICS_KEY, JSON.stringify(counters));
+}
+
+export async function recordSMSStatus(
+  kv: KVNamespace,
+  status: string
+): Promise<void> {
+  const counters = await loadCounters(kv);
+  counters.smsStatuses = counters.smsStatuses || {};
+  counters.smsStatuses[status] = (counters.smsStatuses[status] || 0) + 1;
+  await kv.put(METRICS_KEY, JSON.stringify(counters));
+}
+
+export async function recordFetchError(kv: KVNamespace): Promise<void> {
+  const counters = await loadCounters(kv);
+  counters.fetchErrors++;
+  await kv.put(METRICS_KEY, JSON.stringify(counters));
+}
+
+// renderMetrics formats everything in the prometheus text exposition format.
+// states holds the stored state of each location, keyed by its name ("" for
+// the default location, which gets no location label).
+export async function renderMetrics(
+  kv: KVNamespace,
+  states: Map<string, State | null>,
+  precision: number
+): Promise<string> {
+  const counters = await loadCounters(kv);
+  const lines: string[] = [];
+  const realtime: string[] = [];
+  const tenMinuteAvg: string[] = [];
+  for (let [location, state] of states) {
+    if (!state?.lastReadings) {
+      continue;
+    }
+    const labels = location ? `{location="${location}"}` : "";
+    const readings = roundReadings(state.lastReadings, precision);
+    realtime.push(`aqimon_aqi_realtime${labels} ${readings.realtime}`);
+    tenMinuteAvg.push(
+      `aqimon_aqi_ten_minute_avg${labels} ${readings.tenMinuteAvg}`
+    );
+  }
+  if (realtime.length > 0) {
+    lines.push(
+      "# HELP aqimon_aqi_realtime Most recent real-time AQI reading.",
+      "# TYPE aqimon_aqi_realtime gauge",
+      ...realtime,
+      "# HELP aqimon_aqi_ten_minute_avg Most recent 10 minute average AQI reading.",
+      "# TYPE aqimon_aqi_ten_minute_avg gauge",
+      ...tenMinuteAvg
+    );
+  }
+  lines.push(
+    "# HELP aqimon_notifications_sent_total Notifications sent, by event.",
+    "# TYPE aqimon_notifications_sent_total counter"
+  );
+  for (let [event, n] of Object.entries(counters.notificationsSent)) {
+    lines.push(`aqimon_notifications_sent_total{event="${event}"} ${n}`);
+  }
+  if (counters.smsStatuses) {
+    lines.push(
+      "# HELP aqimon_sms_status_total Final delivery statuses of sms, as reported by twilio.",
+      "# TYPE aqimon_sms_status_total counter"
+    );
+    for (let [status, n] of Object.entries(counters.smsStatuses)) {
+      lines.push(`aqimon_sms_status_total{status="${status}"} ${n}`);
+    }
+  }
+  lines.push(
+    "# HELP aqimon_fetch_errors_total Failed attempts to fetch sensor data.",
+    "# TYPE aqimon_fetch_errors_total counter",
+    `aqimon_fetch_errors_total ${counters.fetchErrors}`
+  );
+  return lines.join("\n") + "\n";
+}
+
+export type PushgatewayConfig = {
+  url: string; // e.g. https://pushgateway.example.com
+  username?: string;
+  password?: string;
+  timeout: number; // milliseconds
+  precision: number; // decimal places to push the readings with
+};
+
+// pushReadings pushes the readings to a prometheus pushgateway, grouped by job
+// "aqimon" and the sensor id as the instance (and the location, if it has a
+// name), replacing whatever was pushed for that group before.
+export async function pushReadings(
+  config: PushgatewayConfig,
+  results: SensorResults,
+  location?: string
+): Promise<void> {
+  let group = `/metrics/job/aqimon/instance/${encodeURIComponent(
+    results.sensorID || "unknown"
+  )}`;
+  if (location) {
+    group += `/location/${encodeURIComponent(location)}`;
+  }
+  const lines = [
+    "# HELP aqimon_aqi_realtime Most recent real-time AQI reading.",
+    "# TYPE aqimon_aqi_realtime gauge",
+    `aqimon_aqi_realtime ${roundAQI(results.realtime, config.precision)}`,
+    "# HELP aqimon_aqi_ten_minute_avg Most recent 10 minute average AQI reading.",
+    "# TYPE aqimon_aqi_ten_minute_avg gauge",
+    `aqimon_aqi_ten_minute_avg ${roundAQI(
+      results.tenMinuteAvg,
+      config.precision
+    )}`,
+    "# HELP aqimon_backup_sensor Whether the readings came from a backup sensor.",
+    "# TYPE aqimon_backup_sensor gauge",
+    `aqimon_backup_sensor ${results.backup ? 1 : 0}`,
+  ];
+  const headers: Record<string, string> = {
+    "user-agent": userAgent(),
+    "content-type": "text/plain; version=0.0.4",
+  };
+  if (config.username) {
+    headers.authorization = `Basic ${btoa(
+      `${config.username}:${config.password || ""}`
+    )}`;
+  }
+  const response = await fetchWithTimeout(
+    `${config.url.replace(/\/+$/, "")}${group}`,
+    { method: "PUT", headers, body: lines.join("\n") + "\n" },
+    config.timeout
+  );
+  if (!response.ok) {
+    throw new Error(
+      `non-ok status returned from the pushgateway (${response.status}): ${await response.text()}`
+    );
+  }
+}
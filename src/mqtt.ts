@@ -0,0 +1,221 @@
+import { AirQualityIndex, roundAQI } from "./aqi";
+import { SensorResults } from "./purpleAir";
+import { userAgent } from "./version";
+
+export type MQTTConfig = {
+  broker: string; // ws:// or wss:// url of the broker's websocket listener
+  username?: string;
+  password?: string;
+  discoveryPrefix: string;
+  topicPrefix: string;
+  location?: string; // each named location shows up as its own device
+  index: AirQualityIndex;
+  precision: number; // decimal places to publish the readings with
+};
+
+const CONNACK_TIMEOUT = 1000 * 5;
+
+// MQTTPublisher publishes every reading to an MQTT broker, along with Home
+// Assistant's discovery config so the readings show up as sensor entities.
+// workers can't open raw tcp sockets, so the broker has to accept MQTT over
+// websockets.
+export class MQTTPublisher {
+  constructor(private config: MQTTConfig) {}
+
+  async publish(results: SensorResults): Promise<void> {
+    const location = this.config.location;
+    const node = location ? `aqimon_${location}` : "aqimon";
+    const stateTopic = location
+      ? `${this.config.topicPrefix}/${location}/state`
+      : `${this.config.topicPrefix}/state`;
+    const conn = await MQTTConnection.open(this.config);
+    try {
+      for (let sensor of sensors(this.config.index)) {
+        conn.publish(
+          `${this.config.discoveryPrefix}/sensor/${node}/${sensor.id}/config`,
+          JSON.stringify({
+            name: sensor.name,
+            unique_id: `${node}_${sensor.id}`,
+            state_topic: stateTopic,
+            value_template: `{{ value_json.${sensor.field} }}`,
+            ...sensor.extra,
+            device: {
+              identifiers: [node],
+              name: location ? `aqimon (${location})` : "aqimon",
+            },
+          }),
+          true
+        );
+      }
+      conn.publish(
+        stateTopic,
+        JSON.stringify({
+          realtime: roundAQI(results.realtime, this.config.precision),
+          tenMinuteAvg: roundAQI(results.tenMinuteAvg, this.config.precision),
+          category: this.config.index.category(results.tenMinuteAvg),
+          sensorID: results.sensorID || null,
+        }),
+        false
+      );
+    } finally {
+      conn.close();
+    }
+  }
+}
+
+// the ids stay the same whatever the index, so that switching it doesn't
+// leave stale entities behind
+function sensors(index: AirQualityIndex) {
+  const value = {
+    unit_of_measurement: index.name,
+    device_class: "aqi",
+    state_class: "measurement",
+  };
+  return [
+    {
+      id: "aqi_realtime",
+      name: `${index.name} (real-time)`,
+      field: "realtime",
+      extra: value,
+    },
+    {
+      id: "aqi_ten_minute_avg",
+      name: `${index.name} (10 minute average)`,
+      field: "tenMinuteAvg",
+      extra: value,
+    },
+    { id: "category", name: "Air quality", field: "category", extra: {} },
+  ];
+}
+
+// MQTTConnection speaks just enough MQTT 3.1.1 to publish at QoS 0.
+class MQTTConnection {
+  private constructor(private ws: WebSocket) {}
+
+  static async open(config: MQTTConfig): Promise<MQTTConnection> {
+    const url = new URL(config.broker);
+    if (url.protocol !== "wss:" && url.protocol !== "ws:") {
+      throw new Error("MQTT_BROKER must be a ws:// or wss:// url");
+    }
+    // workers open websockets with a regular fetch
+    url.protocol = url.protocol === "wss:" ? "https:" : "http:";
+    let response = await fetch(url.toString(), {
+      headers: {
+        "user-agent": userAgent(),
+        upgrade: "websocket",
+        "sec-websocket-protocol": "mqtt",
+      },
+    });
+    const ws = response.webSocket;
+    if (!ws) {
+      throw new Error(
+        `mqtt broker did not accept the websocket (${response.status})`
+      );
+    }
+    ws.accept();
+    const connack = nextMessage(ws, CONNACK_TIMEOUT);
+    ws.send(connectPacket(config));
+    const ack = await connack;
+    // CONNACK: 0x20, remaining length 2, session present, return code
+    if (ack[0] !== 0x20 || ack.length < 4) {
+      ws.close();
+      throw new Error("mqtt broker did not acknowledge the connection");
+    }
+    if (ack[3] !== 0) {
+      ws.close();
+      throw new Error(
+        `mqtt broker refused the connection (${
+          CONNACK_ERRORS[ack[3]] || `return code ${ack[3]}`
+        })`
+      );
+    }
+    return new MQTTConnection(ws);
+  }
+
+  publish(topic: string, payload: string, retain: boolean): void {
+    const body = concat(encodeString(topic), encoder.encode(payload));
+    this.ws.send(packet(0x30 | (retain ? 0x01 : 0x00), body));
+  }
+
+  close(): void {
+    this.ws.send(packet(0xe0, new Uint8Array(0))); // DISCONNECT
+    this.ws.close();
+  }
+}
+
+const CONNACK_ERRORS: Record<number, string> = {
+  1: "unacceptable protocol version",
+  2: "client identifier rejected",
+  3: "server unavailable",
+  4: "bad user name or password",
+  5: "not authorized",
+};
+
+const encoder = new TextEncoder();
+
+function connectPacket(config: MQTTConfig): Uint8Array {
+  let flags = 0x02; // clean session
+  const payload = [encodeString(`aqimon-${Date.now().toString(36)}`)];
+  if (config.username !== undefined) {
+    flags |= 0x80;
+    payload.push(encodeString(config.username));
+  }
+  if (config.password !== undefined) {
+    flags |= 0x40;
+    payload.push(encodeString(config.password));
+  }
+  const header = concat(
+    encodeString("MQTT"),
+    new Uint8Array([0x04, flags, 0x00, 0x3c]) // level 4, 60s keep alive
+  );
+  return packet(0x10, concat(header, ...payload));
+}
+
+function packet(type: number, body: Uint8Array): Uint8Array {
+  // the remaining length is a base-128 varint
+  const length: number[] = [];
+  let n = body.length;
+  do {
+    let b = n % 128;
+    n = Math.floor(n / 128);
+    length.push(n > 0 ? b | 0x80 : b);
+  } while (n > 0);
+  return concat(new Uint8Array([type, ...length]), body);
+}
+
+function encodeString(s: string): Uint8Array {
+  const bytes = encoder.encode(s);
+  const length = new Uint8Array([bytes.length >> 8, bytes.length & 0xff]);
+  return concat(length, bytes);
+}
+
+function concat(...parts: Uint8Array[]): Uint8Array {
+  const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+  let offset = 0;
+  for (let p of parts) {
+    out.set(p, offset);
+    offset += p.length;
+  }
+  return out;
+}
+
+function nextMessage(ws: WebSocket, timeout: number): Promise<Uint8Array> {
+  return new Promise((resolve, reject) => {
+    const timer = setTimeout(() => {
+      reject(new Error("timed out waiting for the mqtt broker"));
+    }, timeout);
+    ws.addEventListener("message", (event) => {
+      clearTimeout(timer);
+      const data = event.data;
+      resolve(
+        typeof data === "string"
+          ? encoder.encode(data)
+          : new Uint8Array(data as ArrayBuffer)
+      );
+    });
+    ws.addEventListener("close", () => {
+      clearTimeout(timer);
+      reject(new Error("mqtt broker closed the connection"));
+    });
+  });
+}
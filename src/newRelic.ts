@@ -12,12 +12,16 @@ class NRLogger {
     this.addLog("info", message, attributes);
   }
 
+  warn(message: string, attributes: Record<string, any> = {}): void {
+    this.addLog("warn", message, attributes);
+  }
+
   error(message: string, attributes: Record<string, any> = {}): void {
     this.addLog("error", message, attributes);
   }
 
   private addLog(
-    level: "info" | "error",
+    level: "info" | "warn" | "error",
     message: string,
     attributes: Record<string, any> = {}
   ) {
@@ -60,6 +64,13 @@ export function logInfo(
   return globalLogger.info(message, attributes);
 }
 
+export function logWarn(
+  message: string,
+  attributes: Record<string, any> = {}
+): void {
+  return globalLogger.warn(message, attributes);
+}
+
 export function logError(
   message: string,
   attributes: Record<string, any>
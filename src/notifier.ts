@@ -0,0 +1,243 @@
+import { AirQualityIndex, roundAQI } from "./aqi";
+import { SensorResults } from "./purpleAir";
+
+export type AirQualityEvent =
+  | "air_quality_good"
+  | "air_quality_bad"
+  | "air_quality_worse"
+  | "air_quality_better"
+  | "air_quality_still_bad";
+
+export type Notification = {
+  event: AirQualityEvent;
+  readings: SensorResults;
+  category: string;
+  previousCategory: string;
+  index?: string; // name of the index the readings are on, "AQI" if unset
+  precision?: number; // decimal places to report the readings with, 0 if unset
+  trend?: Trend;
+  location?: string; // name of the location, unset for the default one
+  message?: string; // replaces the default wording of composeMessage
+  test?: boolean; // sent on request, to check that notifications get through
+  startup?: boolean; // sent once a new build starts checking (NOTIFY_ON_START)
+  primaryDown?: boolean; // sent once the primary sensor has been down a while
+  flatline?: boolean; // sent once a sensor seems stuck on the same reading
+  noteBackup?: boolean; // mention it when the readings came from a backup
+  // unix epoch (milliseconds) the bad air started, telling apart episodes
+  episode?: number;
+};
+
+// Notice is a one-off notification about the monitor itself rather than the
+// air. it carries the event of the current zone only so that the wording
+// fits, so anything acting on the event (an IFTTT applet, an sms
+// subscription) should leave it be.
+export type Notice = "startup" | "primary_down" | "flatline";
+
+export function noticeOf(n: Notification): Notice | undefined {
+  if (n.startup) {
+    return "startup";
+  } else if (n.primaryDown) {
+    return "primary_down";
+  } else if (n.flatline) {
+    return "flatline";
+  }
+  return undefined;
+}
+
+export type Trend = {
+  delta: number; // change in the 10 minute average AQI, per 10 minutes
+  label: string;
+  // when the next category is reached, if it keeps changing at this rate
+  eta?: { category: string; minutes: number };
+};
+
+const TEN_MINUTES = 1000 * 60 * 10;
+// projecting further ahead than this is guesswork
+const MAX_ETA_MINUTES = 60 * 6;
+
+// trendOf describes how quickly the 10 minute average went from previous to
+// current, over elapsed milliseconds, and (given the index) how soon that
+// would reach the next category.
+export function trendOf(
+  previous: SensorResults,
+  current: SensorResults,
+  elapsed: number,
+  index?: AirQualityIndex
+): Trend {
+  let delta = current.tenMinuteAvg - previous.tenMinuteAvg;
+  if (elapsed > 0) {
+    delta = (delta / elapsed) * TEN_MINUTES;
+  }
+  delta = roundToDecimal(delta, 0);
+  let label = "steady";
+  if (delta >= 20) {
+    label = "rising fast";
+  } else if (delta > 2) {
+    label = "rising slowly";
+  } else if (delta <= -20) {
+    label = "improving fast";
+  } else if (delta < -2) {
+    label = "improving slowly";
+  }
+  const trend: Trend = { delta, label };
+  // the realtime reading leads the average, when the two are heading in
+  // different directions the average is about to turn
+  const rtDelta = current.realtime - previous.realtime;
+  if (index && elapsed > 0 && label !== "steady" && rtDelta * delta > 0) {
+    const eta = categoryETA(index, current.tenMinuteAvg, delta);
+    if (eta) {
+      trend.eta = eta;
+    }
+  }
+  return trend;
+}
+
+// categoryETA projects value (changing by delta every 10 minutes) linearly
+// into the next category in the direction it is heading.
+function categoryETA(
+  index: AirQualityIndex,
+  value: number,
+  delta: number
+): Trend["eta"] | undefined {
+  const i = index.categories.indexOf(index.category(value));
+  let category: string;
+  let distance: number;
+  if (delta > 0 && i >= 0 && i < index.categories.length - 1) {
+    category = index.categories[i + 1];
+    distance = index.floor(category) - value;
+  } else if (delta < 0 && i > 0) {
+    category = index.categories[i - 1];
+    distance = value - index.floor(index.categories[i]);
+  } else {
+    return undefined;
+  }
+  const minutes = Math.ceil((Math.max(distance, 0) / Math.abs(delta)) * 10);
+  if (isNaN(minutes) || minutes > MAX_ETA_MINUTES) {
+    return undefined;
+  }
+  return { category, minutes };
+}
+
+export interface Notifier {
+  notify(n: Notification): Promise<void>;
+}
+
+// MultiNotifier sends through every notifier at once, giving each of them up
+// to timeout milliseconds (0 waits as long as it takes).
+export class MultiNotifier implements Notifier {
+  constructor(private notifiers: Notifier[], private timeout = 0) {}
+
+  async notify(n: Notification): Promise<void> {
+    const results = await Promise.allSettled(
+      this.notifiers.map((notifier) =>
+        withTimeout(notifier.notify(n), this.timeout)
+      )
+    );
+    const errors: string[] = [];
+    for (let result of results) {
+      if (result.status === "rejected") {
+        errors.push(
+          result.reason instanceof Error
+            ? result.reason.message
+            : String(result.reason)
+        );
+      }
+    }
+    if (errors.length > 0) {
+      throw new Error(
+        `${errors.length} of ${
+          this.notifiers.length
+        } notifiers failed: ${errors.join("; ")}`
+      );
+    }
+  }
+}
+
+// withTimeout rejects once timeout milliseconds have passed without p
+// settling. whatever p is doing carries on, its result just isn't waited for.
+function withTimeout<T>(p: Promise<T>, timeout: number): Promise<T> {
+  if (timeout <= 0) {
+    return p;
+  }
+  let timer: ReturnType<typeof setTimeout>;
+  return Promise.race([
+    p,
+    new Promise<T>((_, reject) => {
+      timer = setTimeout(
+        () => reject(new Error(`timed out after ${timeout}ms`)),
+        timeout
+      );
+    }),
+  ]).finally(() => clearTimeout(timer));
+}
+
+export function roundToDecimal(x: number, precision: number): number {
+  let pow10 = Math.pow(10, precision);
+  return Math.round(x * pow10) / pow10;
+}
+
+// notificationTitle is a short summary, for notifiers that take a title or
+// subject along with the message.
+export function notificationTitle(n: Notification): string {
+  const title = n.location
+    ? `Air quality at ${n.location}: ${n.category}`
+    : `Air quality: ${n.category}`;
+  return n.test ? `[test] ${title}` : title;
+}
+
+export function composeMessage(n: Notification): string {
+  if (n.message !== undefined) {
+    return n.message;
+  }
+  const readings = n.readings;
+  let message = "";
+  switch (n.event) {
+    case "air_quality_good":
+      message =
+        "📉👍 Nearby air quality seems to be getting better. Open windows for fresh air.";
+      break;
+    case "air_quality_bad":
+      message =
+        "📈👎 Nearby air quality is getting bad. Close any open windows.";
+      break;
+    case "air_quality_worse":
+      message = `📈😷 Nearby air quality got worse (${n.previousCategory} → ${n.category}). Keep windows closed.`;
+      break;
+    case "air_quality_better":
+      message = `📉🙂 Nearby air quality is improving (${n.previousCategory} → ${n.category}), but is still not great.`;
+      break;
+    case "air_quality_still_bad":
+      message = `⏰😷 Nearby air quality is still bad (${n.category}). Keep windows closed.`;
+      break;
+  }
+  if (n.location) {
+    message = `[${n.location}] ${message}`;
+  }
+  if (n.test) {
+    message = `🧪 TEST, nothing has changed. ${message}`;
+  }
+  message += "\n";
+  message += `Level: ${n.category} (${n.index || "AQI"} ${roundAQI(
+    readings.tenMinuteAvg,
+    n.precision || 0
+  )})`;
+  if (readings.dominantPollutant === "pm10") {
+    message += " (mostly PM10)";
+  }
+  if (n.trend) {
+    const sign = n.trend.delta > 0 ? "+" : "";
+    message += `\nTrend: ${n.trend.label} (${sign}${n.trend.delta} per 10m)`;
+    if (n.trend.eta) {
+      message += `, at this rate ${n.trend.eta.category} in ~${n.trend.eta.minutes}m`;
+    }
+  }
+  if (n.noteBackup && readings.backup) {
+    message += `\n(using backup sensor ${readings.sensorID})`;
+  }
+  message += "\n";
+  message += `(avg10_pm2.5: ${roundAQI(
+    readings.tenMinuteAvg,
+    n.precision || 0
+  )}, rt_pm2.5: ${roundAQI(readings.realtime, n.precision || 0)})`;
+  return message;
+}
@@ -0,0 +1,62 @@
+import {
+  AirQualityEvent,
+  composeMessage,
+  Notification,
+  notificationTitle,
+  Notifier,
+} from "./notifier";
+import { userAgent } from "./version";
+
+export type NtfyConfig = {
+  server: string;
+  topic: string;
+  token?: string;
+};
+
+const PRIORITIES: Record<AirQualityEvent, number> = {
+  air_quality_bad: 4,
+  air_quality_worse: 4,
+  air_quality_better: 3,
+  air_quality_still_bad: 3,
+  air_quality_good: 3,
+};
+
+const TAGS: Record<AirQualityEvent, string[]> = {
+  air_quality_bad: ["warning", "mask"],
+  air_quality_worse: ["warning", "chart_with_upwards_trend"],
+  air_quality_better: ["chart_with_downwards_trend"],
+  air_quality_still_bad: ["alarm_clock", "mask"],
+  air_quality_good: ["white_check_mark"],
+};
+
+export class NtfyNotifier implements Notifier {
+  constructor(private config: NtfyConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    const headers: Record<string, string> = {
+      "user-agent": userAgent(),
+      "content-type": "application/json",
+    };
+    if (this.config.token) {
+      headers["authorization"] = `Bearer ${this.config.token}`;
+    }
+    // publishing as json rather than with headers keeps the emoji in the
+    // message and title intact
+    let response = await fetch(this.config.server.replace(/\/+$/, ""), {
+      method: "POST",
+      headers,
+      body: JSON.stringify({
+        topic: this.config.topic,
+        title: notificationTitle(n),
+        message: composeMessage(n),
+        priority: PRIORITIES[n.event],
+        tags: TAGS[n.event],
+      }),
+    });
+    if (!response.ok) {
+      throw new Error(
+        `non-ok status returned from ntfy (${response.status}): ${await response.text()}`
+      );
+    }
+  }
+}
@@ -0,0 +1,110 @@
+import {
+  AQHICategory,
+  AQICategory,
+  CAQICategory,
+  CPCBCategory,
+  roundAQI,
+} from "./aqi";
+import {
+  AirQualityEvent,
+  noticeOf,
+  Notification,
+  Notifier,
+} from "./notifier";
+import { userAgent } from "./version";
+
+export type PagerDutyConfig = {
+  routingKey: string;
+};
+
+// every event (for a location) refers to the same incident, so that
+// everything after air_quality_bad updates it and air_quality_good resolves it
+const DEDUP_KEY = "aqimon/air_quality";
+
+const ACTIONS: Record<AirQualityEvent, "trigger" | "resolve"> = {
+  air_quality_bad: "trigger",
+  air_quality_worse: "trigger",
+  air_quality_better: "trigger",
+  air_quality_still_bad: "trigger",
+  air_quality_good: "resolve",
+};
+
+// keyed by category name, across every index (names they share, like "Good",
+// mean the same thing)
+const SEVERITIES: Record<string, string> = {
+  [AQICategory.Good]: "info",
+  [AQICategory.Moderate]: "info",
+  [AQICategory.UnhealthySensitive]: "warning",
+  [AQICategory.Unhealthy]: "error",
+  [AQICategory.VeryUnhealthy]: "critical",
+  [AQICategory.Hazardous]: "critical",
+  [AQHICategory.Low]: "info",
+  [AQHICategory.Moderate]: "warning",
+  [AQHICategory.High]: "error",
+  [AQHICategory.VeryHigh]: "critical",
+  [CPCBCategory.Satisfactory]: "info",
+  [CPCBCategory.ModeratelyPolluted]: "warning",
+  [CPCBCategory.Poor]: "error",
+  [CPCBCategory.VeryPoor]: "critical",
+  [CPCBCategory.Severe]: "critical",
+  [CAQICategory.VeryLow]: "info",
+  [CAQICategory.Low]: "info",
+  [CAQICategory.Medium]: "warning",
+  [CAQICategory.High]: "error",
+  [CAQICategory.VeryHigh]: "critical",
+};
+
+// tests get an incident of their own, so that they don't resolve (or add to)
+// a real one
+function dedupKey(n: Notification): string {
+  const key = n.location ? `${DEDUP_KEY}/${n.location}` : DEDUP_KEY;
+  return n.test ? `${key}/test` : key;
+}
+
+export class PagerDutyNotifier implements Notifier {
+  constructor(private config: PagerDutyConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    if (noticeOf(n)) {
+      // nothing to page anyone about (on every deploy), and the air quality
+      // incident is no place for sensor trouble
+      return;
+    }
+    const aqi = roundAQI(n.readings.tenMinuteAvg, n.precision || 0);
+    let summary = `Air quality${n.location ? ` at ${n.location}` : ""} is ${
+      n.category
+    } (${n.index || "AQI"} ${aqi})`;
+    if (n.test) {
+      summary = `[test] ${summary}`;
+    }
+    let response = await fetch("https://events.pagerduty.com/v2/enqueue", {
+      method: "POST",
+      headers: {
+        "user-agent": userAgent(),
+        "content-type": "application/json",
+      },
+      body: JSON.stringify({
+        routing_key: this.config.routingKey,
+        event_action: n.test ? "trigger" : ACTIONS[n.event],
+        dedup_key: dedupKey(n),
+        payload: {
+          summary,
+          source: n.readings.sensorID || "aqimon",
+          severity: n.test ? "info" : SEVERITIES[n.category] || "warning",
+          custom_details: {
+            event: n.event,
+            location: n.location,
+            previous_category: n.previousCategory,
+            "avg10_pm2.5": aqi,
+            "rt_pm2.5": roundAQI(n.readings.realtime, n.precision || 0),
+          },
+        },
+      }),
+    });
+    if (!response.ok) {
+      throw new Error(
+        `non-ok status returned from pagerduty (${response.status}): ${await response.text()}`
+      );
+    }
+  }
+}
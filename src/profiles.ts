@@ -0,0 +1,80 @@
+const PROFILE_KEY = "profile";
+
+// the vars a profile may set, the ones worth tuning together
+export const PROFILE_VARS = [
+  "AQ_THRESHOLD",
+  "AQ_THRESHOLD_HIGH",
+  "AQ_THRESHOLD_LOW",
+  "NOTIFY_COOLDOWN",
+  "ESCALATION_SCHEDULE",
+  "CHECK_INTERVAL",
+  "DECISION_METRIC",
+];
+
+// Profiles are named sets of vars, applied over the configured ones. an empty
+// value unsets the var.
+export type Profiles = Record<string, Record<string, string>>;
+
+// parseProfiles parses PROFILES, a json object of profiles like:
+//
+//   {"smoke": {"AQ_THRESHOLD": "moderate", "ESCALATION_SCHEDULE": "30m"}}
+//
+// adding to (or replacing) the builtin ones.
+export function parseProfiles(
+  raw: string | undefined,
+  builtin: Profiles
+): Profiles {
+  if (!raw) {
+    return builtin;
+  }
+  let parsed: unknown;
+  try {
+    parsed = JSON.parse(raw);
+  } catch (e) {
+    throw new Error(`PROFILES is not valid json: ${e.message}`);
+  }
+  if (typeof parsed !== "object" || parsed === null || Array.isArray(parsed)) {
+    throw new Error("PROFILES must be a json object");
+  }
+  const profiles = { ...builtin };
+  for (let [name, vars] of Object.entries(parsed)) {
+    if (typeof vars !== "object" || vars === null || Array.isArray(vars)) {
+      throw new Error(`profile "${name}" must be a json object`);
+    }
+    profiles[name] = {};
+    for (let [key, value] of Object.entries(vars)) {
+      if (!PROFILE_VARS.includes(key)) {
+        throw new Error(
+          `profile "${name}" can't set ${key} (only ${PROFILE_VARS.join(
+            ", "
+          )})`
+        );
+      }
+      if (typeof value !== "string" && typeof value !== "number") {
+        throw new Error(`${key} of profile "${name}" must be a string`);
+      }
+      profiles[name][key] = String(value);
+    }
+  }
+  return profiles;
+}
+
+// loadProfileName returns the profile picked at runtime (through /profile),
+// which takes precedence over PROFILE, or null if none was.
+export async function loadProfileName(
+  kv: KVNamespace
+): Promise<string | null> {
+  return kv.get(PROFILE_KEY);
+}
+
+// storeProfileName picks the profile at runtime, or with null goes back to
+// PROFILE.
+export async function storeProfileName(
+  kv: KVNamespace,
+  name: string | null
+): Promise<void> {
+  if (name === null) {
+    return kv.delete(PROFILE_KEY);
+  }
+  return kv.put(PROFILE_KEY, name);
+}
@@ -1,110 +1,675 @@
-import { logInfo } from "./newRelic";
+import { AirQualityIndex, overallAQI, Pollutant } from "./aqi";
+import { cachedFetch } from "./cache";
+import { fetchWithRetry, fetchWithTimeout, RetryPolicy } from "./http";
+import { logWarn } from "./newRelic";
+import {
+  combineErrors,
+  NoResultsError,
+  SensorSource,
+  StaleDataError,
+  UpstreamNotJSONError,
+  UpstreamSchemaError,
+  UpstreamStatusError,
+} from "./source";
+import { userAgent } from "./version";
 
 const STALE_THRESHOLD = 1000 * 60 * 10;
+// channels that are this close (µg/m³) always agree, no matter the percentage
+const MIN_DIVERGENCE = 5;
 
 export type SensorResults = {
   realtime: number;
   tenMinuteAvg: number;
+  dominantPollutant?: Pollutant;
+  sensorID?: string; // whichever sensor ended up providing the readings
+  backup?: boolean; // the readings came from a backup, not the primary sensor
+  pm25?: number; // 10 minute average PM2.5 (µg/m³), if the source has it
+  pm25Realtime?: number; // realtime PM2.5 (µg/m³), if the source has it
 };
 
-export async function getSensorData(
-  sensorIDs: string[]
-): Promise<SensorResults> {
-  SENSOR_ITER: for (let sensorID of sensorIDs) {
-    let response = await fetch(
+export type PurpleAirOptions = {
+  api: "legacy" | "v1";
+  apiKey?: string;
+  epaCorrection: boolean;
+  aggregate: Aggregate;
+  includePM10: boolean;
+  retry: RetryPolicy;
+  maxDivergence: number; // percent, 0 disables the check
+  index: AirQualityIndex;
+  cacheTTL: number; // milliseconds, 0 disables the cache
+  maxPM: number; // PM2.5 (µg/m³) above which channels are dropped, 0 disables
+};
+
+type PMReadings = {
+  realtime: number[];
+  tenMinuteAvg: number[];
+  pm10?: number[];
+  humidity?: number; // relative humidity (%)
+};
+
+// PurpleAirSource reads from each sensor in order (the first being the
+// primary, the rest backups) until one of them returns fresh data.
+export class PurpleAirSource implements SensorSource {
+  constructor(
+    private sensorIDs: string[],
+    private options: PurpleAirOptions
+  ) {}
+
+  async readings(): Promise<SensorResults> {
+    const failures: string[] = [];
+    const errors: Error[] = [];
+    for (let [i, sensorID] of this.sensorIDs.entries()) {
+      try {
+        const pm = await this.sensorPM(sensorID);
+        const results = toResults(sensorID, pm, this.options);
+        if (i > 0) {
+          results.backup = true;
+        }
+        return results;
+      } catch (e) {
+        logWarn("sensor returned unusable results", {
+          sensorID,
+          error: e.message,
+        });
+        failures.push(`${sensorID}: ${e.message}`);
+        errors.push(e);
+      }
+    }
+    throw combineErrors(
+      `all sensors returned unusable results (${failures.join("; ")})`,
+      errors
+    );
+  }
+
+  // sensorPM returns the PM readings for each of the sensor's channels,
+  // throwing if the sensor has nothing fresh to offer.
+  private async sensorPM(sensorID: string): Promise<PMReadings> {
+    if (this.options.api === "v1") {
+      const result = await fetchJSON<PurpleAirV1>(
+        `https://api.purpleair.com/v1/sensors/${sensorID}`,
+        this.options.retry,
+        { "x-api-key": this.options.apiKey || "" },
+        this.options.cacheTTL
+      );
+      return parseV1(result);
+    }
+    const result = await fetchJSON<PurpleAir>(
       `https://www.purpleair.com/json?show=${sensorID}`,
-      { headers: { "user-agent": "github.com/nkcmr/aqimon" } }
+      this.options.retry,
+      {},
+      this.options.cacheTTL
+    );
+    return parseLegacy(sensorID, result);
+  }
+}
+
+// PurpleAirGroupSource reads every member of a PurpleAir (v1) group in one
+// request, and combines their readings with aggregate (e.g. the mean for a
+// neighborhood, or max for the worst of it). members without fresh data are
+// left out.
+export class PurpleAirGroupSource implements SensorSource {
+  constructor(
+    private groupID: string,
+    private aggregate: Aggregate,
+    private options: PurpleAirOptions
+  ) {
+    if (!options.apiKey) {
+      throw new Error("PURPLE_AIR_API_KEY is required to read a group");
+    }
+  }
+
+  async readings(): Promise<SensorResults> {
+    const fields = ["last_seen", "humidity", "pm2.5", "pm2.5_10minute"];
+    if (this.options.includePM10) {
+      fields.push("pm10.0");
+    }
+    const result = await fetchJSON<PurpleAirGroupV1>(
+      `https://api.purpleair.com/v1/groups/${encodeURIComponent(
+        this.groupID
+      )}/members?fields=${fields.join(",")}`,
+      this.options.retry,
+      { "x-api-key": this.options.apiKey || "" },
+      this.options.cacheTTL
+    );
+    const sensorID = `group:${this.groupID}`;
+    // each member is treated like a channel of a single sensor, except that
+    // members are not expected to agree with each other
+    return toResults(sensorID, parseGroupV1(sensorID, result), {
+      ...this.options,
+      aggregate: this.aggregate,
+      maxDivergence: 0,
+    });
+  }
+}
+
+// combine reduces the per-channel readings down to a single PM2.5 value,
+// applying the EPA correction if it is enabled.
+function combine(
+  sensorID: string,
+  pm: PMReadings,
+  options: PurpleAirOptions
+): { realtime: number; tenMinuteAvg: number } {
+  if (options.maxPM > 0) {
+    pm = {
+      ...pm,
+      realtime: dropSpikes(sensorID, "realtime", pm.realtime, options.maxPM),
+      tenMinuteAvg: dropSpikes(
+        sensorID,
+        "tenMinuteAvg",
+        pm.tenMinuteAvg,
+        options.maxPM
+      ),
+    };
+  }
+  if (options.maxDivergence > 0) {
+    checkAgreement(sensorID, pm.realtime, options.maxDivergence);
+    checkAgreement(sensorID, pm.tenMinuteAvg, options.maxDivergence);
+  }
+  let realtime = options.aggregate(pm.realtime);
+  let tenMinuteAvg = options.aggregate(pm.tenMinuteAvg);
+  if (realtime === null || tenMinuteAvg === null) {
+    throw new NoResultsError("sensor returned no readings");
+  }
+  if (options.epaCorrection) {
+    if (pm.humidity === undefined || isNaN(pm.humidity)) {
+      logWarn("humidity unavailable, skipping epa correction", { sensorID });
+    } else {
+      realtime = correctPM(realtime, pm.humidity);
+      tenMinuteAvg = correctPM(tenMinuteAvg, pm.humidity);
+    }
+  }
+  return { realtime, tenMinuteAvg };
+}
+
+// dropSpikes leaves out channels reading more than maxPM, which happens e.g.
+// while a sensor is being serviced, throwing if that leaves none (so that a
+// backup sensor gets used instead).
+function dropSpikes(
+  sensorID: string,
+  reading: string,
+  channels: number[],
+  maxPM: number
+): number[] {
+  const plausible = channels.filter((pm) => pm <= maxPM);
+  if (plausible.length < channels.length) {
+    logWarn("discarded implausible sensor reading", {
+      sensorID,
+      reading,
+      channels,
+      maxPM,
+    });
+  }
+  if (plausible.length === 0 && channels.length > 0) {
+    throw new Error(
+      `implausible ${reading} reading (${channels.join(", ")} > ${maxPM})`
+    );
+  }
+  return plausible;
+}
+
+// checkAgreement throws when a sensor's A and B channels disagree by more than
+// maxDivergence percent, which usually means one of them is faulty. there is
+// no telling which one, so the whole sensor is skipped in favor of a backup.
+function checkAgreement(
+  sensorID: string,
+  channels: number[],
+  maxDivergence: number
+): void {
+  if (channels.length !== 2) {
+    return;
+  }
+  const [a, b] = channels;
+  const difference = Math.abs(a - b);
+  const divergence = (difference / ((a + b) / 2)) * 100;
+  if (difference > MIN_DIVERGENCE && divergence > maxDivergence) {
+    logWarn("sensor channels disagree", { sensorID, a, b, divergence });
+    throw new Error(
+      `channels disagree by ${Math.round(divergence)}% (a: ${a}, b: ${b})`
+    );
+  }
+}
+
+// toResults converts a sensor's PM readings into the configured index. PM10 is
+// only reported as a real-time value, so it is compared against both PM2.5
+// readings.
+function toResults(
+  sensorID: string,
+  pm: PMReadings,
+  options: PurpleAirOptions
+): SensorResults {
+  const combined = combine(sensorID, pm, options);
+  const results: SensorResults = {
+    realtime: options.index.fromPM(combined.realtime),
+    tenMinuteAvg: options.index.fromPM(combined.tenMinuteAvg),
+    sensorID,
+    pm25: combined.tenMinuteAvg,
+    pm25Realtime: combined.realtime,
+  };
+  const fromPM10 = options.index.fromPM10;
+  const pm10 =
+    options.includePM10 && fromPM10 ? options.aggregate(pm.pm10 || []) : null;
+  if (fromPM10 && pm10 !== null) {
+    const pm10AQI = fromPM10(pm10);
+    const rt = overallAQI({ "pm2.5": results.realtime, pm10: pm10AQI });
+    const tenm = overallAQI({ "pm2.5": results.tenMinuteAvg, pm10: pm10AQI });
+    results.realtime = rt.aqi;
+    results.tenMinuteAvg = tenm.aqi;
+    results.dominantPollutant = tenm.dominant;
+  }
+  return results;
+}
+
+export type SensorInfo = {
+  label?: string;
+  latitude?: number;
+  longitude?: number;
+  lastSeen: Date;
+  firmware?: string;
+  results?: SensorResults;
+  error?: string; // why there are no results
+};
+
+// sensorInfo describes a sensor, to help confirm it is the right one. unlike
+// readings, it still returns everything it can for sensors with bad data.
+export async function sensorInfo(
+  sensorID: string,
+  options: PurpleAirOptions
+): Promise<SensorInfo> {
+  let info: SensorInfo;
+  let pm: () => PMReadings;
+  if (options.api === "v1") {
+    const result = await fetchJSON<PurpleAirV1>(
+      `https://api.purpleair.com/v1/sensors/${sensorID}`,
+      options.retry,
+      { "x-api-key": options.apiKey || "" }
+    );
+    if (!result.sensor) {
+      throw new Error("sensor not found");
+    }
+    const sensor = result.sensor;
+    info = {
+      label: sensor.name,
+      latitude: sensor.latitude,
+      longitude: sensor.longitude,
+      lastSeen: new Date(sensor.last_seen * 1000),
+      firmware: sensor.firmware_version,
+    };
+    pm = () => parseV1(result);
+  } else {
+    const result = await fetchJSON<PurpleAir>(
+      `https://www.purpleair.com/json?show=${sensorID}`,
+      options.retry
+    );
+    if (!Array.isArray(result?.results)) {
+      throw schemaError("there is no results list", result);
+    }
+    if (result.results.length === 0) {
+      throw new Error("sensor not found");
+    }
+    const primary = result.results[0];
+    info = {
+      label: primary.Label,
+      latitude: primary.Lat,
+      longitude: primary.Lon,
+      lastSeen: new Date(primary.LastSeen * 1000),
+      firmware: primary.Version,
+    };
+    pm = () => parseLegacy(sensorID, result);
+  }
+  try {
+    info.results = toResults(sensorID, pm(), options);
+  } catch (e) {
+    info.error = e.message;
+  }
+  return info;
+}
+
+export type LocalSensorOptions = {
+  url: string;
+  timeout: number; // milliseconds
+};
+
+// LocalPurpleAirSource reads straight from a sensor's own /json endpoint
+// (e.g. exposed through a tunnel), falling back to another source if the
+// sensor can't be reached. the device only reports its own short average, so
+// it is used for both readings.
+export class LocalPurpleAirSource implements SensorSource {
+  constructor(
+    private local: LocalSensorOptions,
+    private options: PurpleAirOptions,
+    private fallback: SensorSource | null
+  ) {}
+
+  async readings(): Promise<SensorResults> {
+    try {
+      return toResults(this.local.url, await this.localPM(), this.options);
+    } catch (e) {
+      if (!this.fallback) {
+        throw e;
+      }
+      logWarn("failed to read local sensor, falling back", {
+        error: e.message,
+      });
+      return { ...(await this.fallback.readings()), backup: true };
+    }
+  }
+
+  private async localPM(): Promise<PMReadings> {
+    const response = await fetchWithTimeout(
+      this.local.url,
+      { headers: { "user-agent": userAgent() } },
+      this.local.timeout
     );
     if (!response.ok) {
-      throw new Error(
-        `non-ok status code returned from purple air (${response.statusText})`
+      throw new UpstreamStatusError(
+        `non-ok status code returned from local sensor (${response.statusText})`,
+        response.status
       );
     }
-    let result = (await response.json()) as PurpleAir;
-    if (result.results.length === 0) {
-      logInfo("purple air sensor returned zero results", { sensorID });
+    const result = (await response.json()) as LocalSensor;
+    // the EPA correction is defined in terms of the CF=1 values
+    const channels = this.options.epaCorrection
+      ? [result.pm2_5_cf_1, result.pm2_5_cf_1_b]
+      : [result.pm2_5_atm, result.pm2_5_atm_b];
+    const pm = channels.filter((v): v is number => typeof v === "number");
+    return {
+      realtime: pm,
+      tenMinuteAvg: pm,
+      pm10: [result.pm10_0_atm, result.pm10_0_atm_b].filter(
+        (v): v is number => typeof v === "number"
+      ),
+      humidity: result.current_humidity,
+    };
+  }
+}
+
+async function fetchJSON<T>(
+  url: string,
+  retry: RetryPolicy,
+  headers: Record<string, string> = {},
+  cacheTTL = 0
+): Promise<T> {
+  let response = await cachedFetch(url, cacheTTL, async () => {
+    const response = await fetchWithRetry(
+      url,
+      { headers: { "user-agent": userAgent(), ...headers } },
+      retry
+    );
+    // checked before it can be cached
+    return response.ok ? checkJSON(response) : response;
+  });
+  if (!response.ok) {
+    throw new UpstreamStatusError(
+      `non-ok status code returned from purple air (${response.statusText})`,
+      response.status
+    );
+  }
+  return (await response.json()) as T;
+}
+
+// checkJSON throws if the response is an html page rather than json, with the
+// start of it, and otherwise returns an unread copy of the response.
+async function checkJSON(response: Response): Promise<Response> {
+  const contentType = response.headers.get("content-type") || "";
+  const body = await response.text();
+  // only html says it for sure, some servers label json text/plain
+  if (/html/i.test(contentType) || body.trimStart().startsWith("<")) {
+    const snippet = body.replace(/\s+/g, " ").trim().slice(0, 100);
+    throw new UpstreamNotJSONError(
+      `purple air returned html instead of json: ${snippet}${
+        body.length > 100 ? "..." : ""
+      }`
+    );
+  }
+  return new Response(body, response);
+}
+
+// schemaError is for a response that is missing what is read from it, listing
+// the fields it does have, to go by when updating.
+function schemaError(what: string, value: unknown): UpstreamSchemaError {
+  const fields =
+    value && typeof value === "object" ? Object.keys(value).slice(0, 10) : [];
+  return new UpstreamSchemaError(
+    `upstream schema may have changed, ${what} (got: ${
+      fields.length > 0 ? fields.join(", ") : JSON.stringify(value)
+    })`
+  );
+}
+
+function checkFresh(lastSeenUnix: number): void {
+  const lastSeen = new Date(lastSeenUnix * 1000);
+  if (Date.now() - lastSeen.getTime() > STALE_THRESHOLD) {
+    throw new StaleDataError(`stale data (last seen ${lastSeen.toJSON()})`);
+  }
+}
+
+function parseLegacy(sensorID: string, result: PurpleAir): PMReadings {
+  if (!Array.isArray(result?.results)) {
+    throw schemaError("there is no results list", result);
+  }
+  if (result.results.length === 0) {
+    throw new NoResultsError("sensor returned zero results");
+  }
+  // a single odd channel is the sensor's problem, all of them are the api's
+  const readable = result.results.filter(
+    (r) =>
+      typeof r?.LastSeen === "number" &&
+      (r.Stats !== undefined || r.PM2_5Value !== undefined)
+  );
+  if (readable.length === 0) {
+    throw schemaError(
+      "no result has a LastSeen and either Stats or PM2_5Value",
+      result.results[0]
+    );
+  }
+  const readings: PMReadings = { realtime: [], tenMinuteAvg: [] };
+  const decodeErrors: string[] = [];
+  let schemaErrors = 0;
+  for (let [channel, subResult] of result.results.entries()) {
+    checkFresh(subResult.LastSeen);
+    try {
+      const pm = legacyPM(sensorID, channel, subResult);
+      readings.realtime.push(pm.realtime);
+      readings.tenMinuteAvg.push(pm.tenMinuteAvg);
+    } catch (e) {
+      logWarn("failed to decode sensor channel stats, skipping channel", {
+        sensorID,
+        channel,
+        error: e.message,
+      });
+      decodeErrors.push(`channel ${channel}: ${e.message}`);
+      if (e instanceof UpstreamSchemaError) {
+        schemaErrors++;
+      }
       continue;
     }
-    const rtPM25Readings: number[] = [];
-    const tenmPM25Readings: number[] = [];
-    for (let subResult of result.results) {
-      const lastSeen = new Date(subResult.LastSeen * 1000);
-      if (Date.now() - subResult.LastSeen * 1000 > STALE_THRESHOLD) {
-        logInfo("stale data coming from sensor", { sensorID, lastSeen });
-        continue SENSOR_ITER;
+    try {
+      const pm10 = parsePMValue("pm10_0_atm", subResult.pm10_0_atm);
+      if (pm10 !== null) {
+        readings.pm10 = (readings.pm10 || []).concat(pm10);
       }
-      try {
-        const stats = JSON.parse(subResult.Stats);
-        if (typeof stats.v !== "number" || typeof stats.v1 !== "number") {
-          throw new Error(`unexpected structure/data for result.stats`);
-        }
-        rtPM25Readings.push(stats.v);
-        tenmPM25Readings.push(stats.v1);
-      } catch (e) {
-        throw new Error(
-          `failed to json decode results stats: ${e.message} ${result}`
-        );
+      const humidity = parsePMValue("humidity", subResult.humidity);
+      if (readings.humidity === undefined && humidity !== null) {
+        readings.humidity = humidity;
       }
+    } catch (e) {
+      logWarn("ignoring malformed sensor channel value", {
+        sensorID,
+        channel,
+        error: e.message,
+      });
     }
-    return {
-      realtime: aqiFromPM(avg(rtPM25Readings)),
-      tenMinuteAvg: aqiFromPM(avg(tenmPM25Readings)),
-    };
   }
-  throw new Error("all sensors returned unusable results");
-}
-
-function aqiFromPM(pm: number): number {
-  if (isNaN(pm)) {
-    return NaN;
-  }
-  if (pm < 0) {
-    return pm;
-  }
-  if (pm > 1000) {
-    return NaN;
-  }
-  /*
-    Good                            0 - 50         0.0 - 15.0         0.0 – 12.0
-    Moderate                        51 - 100           >15.0 - 40        12.1 – 35.4
-    Unhealthy for Sensitive Groups  101 – 150     >40 – 65          35.5 – 55.4
-    Unhealthy                       151 – 200         > 65 – 150       55.5 – 150.4
-    Very Unhealthy                  201 – 300 > 150 – 250     150.5 – 250.4
-    Hazardous                       301 – 400         > 250 – 350     250.5 – 350.4
-    Hazardous                       401 – 500         > 350 – 500     350.5 – 500
-  */
-  if (pm > 350.5) {
-    return calcAQI(pm, 500, 401, 500, 350.5);
-  } else if (pm > 250.5) {
-    return calcAQI(pm, 400, 301, 350.4, 250.5);
-  } else if (pm > 150.5) {
-    return calcAQI(pm, 300, 201, 250.4, 150.5);
-  } else if (pm > 55.5) {
-    return calcAQI(pm, 200, 151, 150.4, 55.5);
-  } else if (pm > 35.5) {
-    return calcAQI(pm, 150, 101, 55.4, 35.5);
-  } else if (pm > 12.1) {
-    return calcAQI(pm, 100, 51, 35.4, 12.1);
-  } else if (pm >= 0) {
-    return calcAQI(pm, 50, 0, 12, 0);
-  }
-  return NaN;
-}
-
-function calcAQI(
-  Cp: number,
-  Ih: number,
-  Il: number,
-  BPh: number,
-  BPl: number
-): number {
-  const a = Ih - Il;
-  const b = BPh - BPl;
-  const c = Cp - BPl;
-  return Math.round((a / b) * c + Il);
-}
-
-function avg(nums: number[]): number {
+  if (readings.realtime.length === 0) {
+    const message = `failed to decode any sensor channel: ${decodeErrors.join(
+      ", "
+    )}`;
+    throw schemaErrors === decodeErrors.length
+      ? new UpstreamSchemaError(message)
+      : new Error(message);
+  }
+  return readings;
+}
+
+// legacyPM reads a channel's PM2.5 from its Stats json, falling back to the
+// plain PM2_5Value field (which has no 10 minute average) when it is missing.
+function legacyPM(
+  sensorID: string,
+  channel: number,
+  result: Result
+): { realtime: number; tenMinuteAvg: number } {
+  if (!result.Stats) {
+    const pm = parsePMValue("PM2_5Value", result.PM2_5Value);
+    if (pm === null) {
+      throw new Error("channel has neither Stats nor PM2_5Value");
+    }
+    logWarn("sensor channel has no stats, using PM2_5Value", {
+      sensorID,
+      channel,
+    });
+    return { realtime: pm, tenMinuteAvg: pm };
+  }
+  let stats: any;
+  try {
+    stats = JSON.parse(result.Stats);
+  } catch (e) {
+    throw schemaError("Stats is not json", result.Stats);
+  }
+  if (typeof stats?.v !== "number" || typeof stats?.v1 !== "number") {
+    throw schemaError("Stats has no v or v1", stats);
+  }
+  return { realtime: stats.v, tenMinuteAvg: stats.v1 };
+}
+
+// parsePMValue parses one of the numeric strings the legacy api reports,
+// returning null when the value is missing or blank.
+function parsePMValue(field: string, value: string | undefined): number | null {
+  if (value === undefined || value.trim() === "") {
+    return null;
+  }
+  const n = Number(value.trim());
+  if (!isFinite(n)) {
+    throw new Error(`${field} is not a number: "${value}"`);
+  }
+  return n;
+}
+
+function parseV1(result: PurpleAirV1): PMReadings {
+  if (typeof result?.sensor?.last_seen !== "number") {
+    throw schemaError("there is no sensor with a last_seen", result?.sensor);
+  }
+  if (!result.sensor.stats) {
+    throw new NoResultsError("sensor returned no stats");
+  }
+  checkFresh(result.sensor.last_seen);
+  // the A and B channels, like the legacy api has them, so that AGGREGATE and
+  // CHANNEL_MAX_DIVERGENCE apply. stats (their average) is for sensors that
+  // don't report them
+  const channels = [result.sensor.stats_a, result.sensor.stats_b].filter(
+    hasPM
+  );
+  if (channels.length === 0) {
+    const stats = result.sensor.stats;
+    if (!hasPM(stats)) {
+      throw schemaError("sensor.stats has no pm2.5 or pm2.5_10minute", stats);
+    }
+    channels.push(stats);
+  }
+  return {
+    realtime: channels.map((c) => c["pm2.5"]),
+    tenMinuteAvg: channels.map((c) => c["pm2.5_10minute"]),
+    pm10:
+      typeof result.sensor["pm10.0"] === "number"
+        ? [result.sensor["pm10.0"]]
+        : undefined,
+    humidity: result.sensor.humidity,
+  };
+}
+
+function hasPM(stats: StatsV1 | undefined): stats is StatsV1 {
+  return (
+    typeof stats?.["pm2.5"] === "number" &&
+    typeof stats?.["pm2.5_10minute"] === "number"
+  );
+}
+
+function parseGroupV1(sensorID: string, result: PurpleAirGroupV1): PMReadings {
+  const fields = result?.fields;
+  if (
+    !Array.isArray(fields) ||
+    !Array.isArray(result.data) ||
+    !["last_seen", "pm2.5", "pm2.5_10minute"].every((f) => fields.includes(f))
+  ) {
+    throw schemaError(
+      "the members have no last_seen, pm2.5 or pm2.5_10minute fields",
+      fields || result
+    );
+  }
+  const rows = (result.data || []).map((row) => {
+    const member: Record<string, number | undefined> = {};
+    (result.fields || []).forEach((field, i) => {
+      member[field] = typeof row[i] === "number" ? row[i] : undefined;
+    });
+    return member;
+  });
+  if (rows.length === 0) {
+    throw new NoResultsError("group has no members");
+  }
+  const fresh = rows.filter(
+    (m) => Date.now() - (m["last_seen"] || 0) * 1000 <= STALE_THRESHOLD
+  );
+  if (fresh.length === 0) {
+    throw new StaleDataError(
+      `stale data (none of the ${rows.length} group members are fresh)`
+    );
+  }
+  if (fresh.length < rows.length) {
+    logWarn("leaving out group members without fresh data", {
+      sensorID,
+      stale: rows.length - fresh.length,
+    });
+  }
+  const readings: PMReadings = { realtime: [], tenMinuteAvg: [] };
+  const humidity: number[] = [];
+  const pm10: number[] = [];
+  for (let m of fresh) {
+    const rt = m["pm2.5"];
+    const tenm = m["pm2.5_10minute"];
+    if (rt === undefined || tenm === undefined) {
+      continue;
+    }
+    readings.realtime.push(rt);
+    readings.tenMinuteAvg.push(tenm);
+    if (m["humidity"] !== undefined) {
+      humidity.push(m["humidity"]);
+    }
+    if (m["pm10.0"] !== undefined) {
+      pm10.push(m["pm10.0"]);
+    }
+  }
+  if (readings.realtime.length === 0) {
+    throw new NoResultsError("no group member reported pm2.5");
+  }
+  // one humidity for the lot is close enough for the EPA correction
+  readings.humidity = avg(humidity) ?? undefined;
+  readings.pm10 = pm10.length > 0 ? pm10 : undefined;
+  return readings;
+}
+
+// correctPM applies the EPA's US-wide correction for PurpleAir sensors, which
+// tend to read high.
+function correctPM(pm: number, humidity: number): number {
+  return 0.534 * pm - 0.0844 * humidity + 5.604;
+}
+
+// an Aggregate combines the readings of each of a sensor's channels into a
+// single value, returning null for an empty list rather than NaN.
+export type Aggregate = (nums: number[]) => number | null;
+
+function avg(nums: number[]): number | null {
+  if (nums.length === 0) {
+    return null;
+  }
   let total = 0;
   for (let n of nums) {
     total += n;
@@ -112,11 +677,82 @@ function avg(nums: number[]): number {
   return total / nums.length;
 }
 
+function median(nums: number[]): number | null {
+  if (nums.length === 0) {
+    return null;
+  }
+  const sorted = [...nums].sort((a, b) => a - b);
+  const mid = Math.floor(sorted.length / 2);
+  if (sorted.length % 2 === 0) {
+    return (sorted[mid - 1] + sorted[mid]) / 2;
+  }
+  return sorted[mid];
+}
+
+function max(nums: number[]): number | null {
+  if (nums.length === 0) {
+    return null;
+  }
+  return Math.max(...nums);
+}
+
+export const AGGREGATES: Record<string, Aggregate> = {
+  mean: avg,
+  median,
+  max,
+};
+
 export interface PurpleAir {
   results: Result[];
 }
 
 export interface Result {
+  Label?: string;
+  Lat?: number;
+  Lon?: number;
+  Version?: string;
   LastSeen: number;
-  Stats: string;
+  Stats?: string;
+  PM2_5Value?: string;
+  humidity?: string;
+  pm10_0_atm?: string;
+}
+
+export interface PurpleAirV1 {
+  sensor?: SensorV1;
+}
+
+export interface SensorV1 {
+  name?: string;
+  latitude?: number;
+  longitude?: number;
+  firmware_version?: string;
+  last_seen: number;
+  humidity?: number;
+  "pm10.0"?: number;
+  stats?: StatsV1;
+  stats_a?: StatsV1;
+  stats_b?: StatsV1;
+}
+
+// https://api.purpleair.com/#api-groups-get-members-data, one row of values
+// (in the order of fields) per member
+export interface PurpleAirGroupV1 {
+  fields?: string[];
+  data?: (number | null)[][];
+}
+
+export interface StatsV1 {
+  "pm2.5": number;
+  "pm2.5_10minute": number;
+}
+
+export interface LocalSensor {
+  current_humidity?: number;
+  pm2_5_atm?: number;
+  pm2_5_atm_b?: number;
+  pm2_5_cf_1?: number;
+  pm2_5_cf_1_b?: number;
+  pm10_0_atm?: number;
+  pm10_0_atm_b?: number;
 }
@@ -0,0 +1,77 @@
+import {
+  AirQualityEvent,
+  composeMessage,
+  Notification,
+  notificationTitle,
+  Notifier,
+} from "./notifier";
+import { userAgent } from "./version";
+
+export type PushoverConfig = {
+  token: string;
+  user: string;
+};
+
+// https://pushover.net/api#priority
+const PRIORITIES: Record<AirQualityEvent, number> = {
+  air_quality_bad: 1,
+  air_quality_worse: 1,
+  air_quality_better: 0,
+  air_quality_still_bad: 0,
+  air_quality_good: 0,
+};
+
+// https://pushover.net/api#sounds
+const SOUNDS: Record<AirQualityEvent, string> = {
+  air_quality_bad: "siren",
+  air_quality_worse: "siren",
+  air_quality_better: "magic",
+  air_quality_still_bad: "pushover",
+  air_quality_good: "magic",
+};
+
+export class PushoverNotifier implements Notifier {
+  constructor(private config: PushoverConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    let response = await fetch("https://api.pushover.net/1/messages.json", {
+      method: "POST",
+      headers: {
+        "user-agent": userAgent(),
+        "content-type": "application/x-www-form-urlencoded",
+      },
+      body: new URLSearchParams({
+        token: this.config.token,
+        user: this.config.user,
+        title: notificationTitle(n),
+        message: composeMessage(n),
+        priority: String(PRIORITIES[n.event]),
+        sound: SOUNDS[n.event],
+      }).toString(),
+    });
+    if (response.status === 429) {
+      // https://pushover.net/api#limits
+      const reset = parseInt(response.headers.get("x-limit-app-reset") || "");
+      throw new Error(
+        `pushover message limit reached for this application${
+          isNaN(reset) ? "" : ` (resets ${new Date(reset * 1000).toJSON()})`
+        }`
+      );
+    }
+    if (!response.ok) {
+      const body = (await response
+        .json()
+        .catch(() => ({}))) as PushoverResponse;
+      throw new Error(
+        `non-ok status returned from pushover (${response.status}): ${
+          (body.errors || []).join(", ") || response.statusText
+        }`
+      );
+    }
+  }
+}
+
+interface PushoverResponse {
+  status: number;
+  errors?: string[];
+}
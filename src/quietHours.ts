@@ -0,0 +1,52 @@
+export type QuietMode = "drop" | "defer";
+
+// QuietHours is a daily window (e.g. 22:00 - 07:00) during which
+// notifications are held back. windows that end before they start wrap around
+// midnight.
+export class QuietHours {
+  private start: number; // minutes since midnight
+  private end: number; // minutes since midnight
+  private clock: Intl.DateTimeFormat;
+
+  constructor(
+    start: string,
+    end: string,
+    timeZone: string,
+    public mode: QuietMode
+  ) {
+    this.start = parseTimeOfDay(start);
+    this.end = parseTimeOfDay(end);
+    // throws a RangeError for unknown time zones
+    this.clock = new Intl.DateTimeFormat("en-US", {
+      timeZone,
+      hour: "2-digit",
+      minute: "2-digit",
+      hourCycle: "h23",
+    });
+  }
+
+  active(at: Date): boolean {
+    let hour = 0;
+    let minute = 0;
+    for (let part of this.clock.formatToParts(at)) {
+      if (part.type === "hour") {
+        hour = parseInt(part.value, 10);
+      } else if (part.type === "minute") {
+        minute = parseInt(part.value, 10);
+      }
+    }
+    const now = hour * 60 + minute;
+    if (this.start <= this.end) {
+      return now >= this.start && now < this.end;
+    }
+    return now >= this.start || now < this.end;
+  }
+}
+
+function parseTimeOfDay(s: string): number {
+  const match = /^(\d{1,2}):(\d{2})$/.exec(s);
+  if (!match || parseInt(match[1], 10) > 23 || parseInt(match[2], 10) > 59) {
+    throw new Error(`invalid time of day "${s}" (expected HH:MM)`);
+  }
+  return parseInt(match[1], 10) * 60 + parseInt(match[2], 10);
+}
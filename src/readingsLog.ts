@@ -0,0 +1,87 @@
+import { AirQualityIndex, roundAQI } from "./aqi";
+import { SensorResults } from "./purpleAir";
+import { locationKey } from "./state";
+
+const READINGS_KEY = "readings";
+
+export type LoggedReading = {
+  timestamp: string; // RFC 3339
+  rt: number;
+  tenmavg: number;
+  category: string;
+  sensor_id: string | null;
+};
+
+export async function loadReadings(
+  kv: KVNamespace,
+  location?: string
+): Promise<LoggedReading[]> {
+  const readings = await kv
+    .get<LoggedReading[]>(locationKey(READINGS_KEY, location), "json")
+    .catch(() => null);
+  return Array.isArray(readings) ? readings : [];
+}
+
+// appendReading adds results to the end of the log, dropping the oldest
+// entries past limit.
+export async function appendReading(
+  kv: KVNamespace,
+  results: SensorResults,
+  index: AirQualityIndex,
+  limit: number,
+  location?: string
+): Promise<void> {
+  const readings = await loadReadings(kv, location);
+  readings.push({
+    timestamp: new Date().toJSON(),
+    rt: results.realtime,
+    tenmavg: results.tenMinuteAvg,
+    category: index.category(results.tenMinuteAvg),
+    sensor_id: results.sensorID || null,
+  });
+  await kv.put(
+    locationKey(READINGS_KEY, location),
+    JSON.stringify(readings.slice(-limit))
+  );
+}
+
+// renderReadings formats the log as newline delimited json, oldest first, with
+// the index values rounded to precision decimal places.
+export function renderReadings(
+  readings: LoggedReading[],
+  precision: number
+): string {
+  return readings
+    .map((r) => ({
+      ...r,
+      rt: roundAQI(r.rt, precision),
+      tenmavg: roundAQI(r.tenmavg, precision),
+    }))
+    .map((r) => JSON.stringify(r) + "\n")
+    .join("");
+}
+
+// parseReadings reads back what renderReadings wrote, e.g. a saved copy of
+// /readings.
+export function parseReadings(text: string): LoggedReading[] {
+  return text
+    .split("\n")
+    .map((line, i) => [line.trim(), i + 1] as const)
+    .filter(([line]) => line !== "")
+    .map(([line, n]) => {
+      let r: LoggedReading;
+      try {
+        r = JSON.parse(line);
+      } catch (e) {
+        throw new Error(`line ${n} is not valid json: ${e.message}`);
+      }
+      if (
+        typeof r?.rt !== "number" ||
+        typeof r.tenmavg !== "number" ||
+        isNaN(Date.parse(r.timestamp))
+      ) {
+        throw new Error(`line ${n} needs a timestamp, rt and tenmavg`);
+      }
+      return r;
+    });
+}
@@ -0,0 +1,44 @@
+import { locationKey } from "./state";
+
+const SAMPLES_KEY = "pm_samples";
+// a day's worth of checks, every minute, whatever the windows are
+const MAX_SAMPLES = 60 * 24;
+
+export type Sample = {
+  at: number; // unix epoch (milliseconds)
+  pm: number; // realtime PM2.5 (µg/m³)
+};
+
+// recordSample adds a realtime PM2.5 reading to the recent samples, dropping
+// any older than keep milliseconds, and returns what is left (oldest first).
+export async function recordSample(
+  kv: KVNamespace,
+  pm: number,
+  now: number,
+  keep: number,
+  location?: string
+): Promise<Sample[]> {
+  const key = locationKey(SAMPLES_KEY, location);
+  let samples = await kv.get<Sample[]>(key, "json").catch(() => null);
+  samples = (Array.isArray(samples) ? samples : []).filter(
+    (s) => s.at > now - keep && s.at <= now
+  );
+  samples.push({ at: now, pm });
+  samples = samples.slice(-MAX_SAMPLES);
+  await kv.put(key, JSON.stringify(samples));
+  return samples;
+}
+
+// rollingAverage is the mean PM2.5 of the samples taken within window
+// milliseconds of now, or NaN if there are none.
+export function rollingAverage(
+  samples: Sample[],
+  window: number,
+  now: number
+): number {
+  const recent = samples.filter((s) => s.at > now - window);
+  if (recent.length === 0) {
+    return NaN;
+  }
+  return recent.reduce((total, s) => total + s.pm, 0) / recent.length;
+}
@@ -0,0 +1,110 @@
+import { fetchWithTimeout } from "./http";
+import { logInfo, logWarn } from "./newRelic";
+import { userAgent } from "./version";
+
+const SENSOR_CONFIG_KEY = "sensor_config";
+
+// the last good config fetched, kept (without expiring) to fall back on
+type StoredConfig = {
+  vars: Record<string, string>;
+  fetchedAt: number; // unix epoch (milliseconds)
+};
+
+// fields of the config, and the vars they set
+const FIELDS: Record<string, string> = {
+  sensor_ids: "SENSOR_IDS",
+  backup_sensor_ids: "BACKUP_SENSOR_IDS",
+  threshold: "AQ_THRESHOLD",
+  threshold_high: "AQ_THRESHOLD_HIGH",
+  threshold_low: "AQ_THRESHOLD_LOW",
+};
+
+export type SensorConfigOptions = {
+  url: string;
+  refresh: number; // milliseconds between fetches
+  timeout: number; // milliseconds
+  // throws if the vars can't be used, e.g. an invalid threshold
+  validate: (vars: Record<string, string>) => void;
+};
+
+// loadSensorConfig returns the vars set by the sensor config at url, fetching
+// it again once the stored copy is older than refresh. when that fails (or
+// what comes back is invalid), the last good config is used until it works
+// again, or null if there never was one.
+export async function loadSensorConfig(
+  kv: KVNamespace,
+  options: SensorConfigOptions,
+  now: number
+): Promise<Record<string, string> | null> {
+  const stored = await kv
+    .get<StoredConfig>(SENSOR_CONFIG_KEY, "json")
+    .catch(() => null);
+  if (stored && now - stored.fetchedAt < options.refresh) {
+    return stored.vars;
+  }
+  try {
+    const response = await fetchWithTimeout(
+      options.url,
+      { headers: { "user-agent": userAgent(), accept: "application/json" } },
+      options.timeout
+    );
+    if (!response.ok) {
+      throw new Error(`non-ok status returned (${response.status})`);
+    }
+    const vars = parseSensorConfig(await response.text());
+    options.validate(vars);
+    await kv.put(SENSOR_CONFIG_KEY, JSON.stringify({ vars, fetchedAt: now }));
+    logInfo("fetched sensor config", vars);
+    return vars;
+  } catch (e) {
+    // only the host is logged, the url may well have a token in it
+    logWarn("failed to fetch sensor config, using the last good one", {
+      host: new URL(options.url).host,
+      error: e.message,
+      fetchedAt: stored ? new Date(stored.fetchedAt) : null,
+    });
+    return stored?.vars || null;
+  }
+}
+
+// parseSensorConfig parses a sensor config like:
+//
+//   {"sensor_ids": ["1234"], "backup_sensor_ids": ["5678"],
+//    "threshold_high": "unhealthy", "threshold_low": 100}
+//
+// into the vars it sets. sensor_ids is required, the rest are optional.
+export function parseSensorConfig(raw: string): Record<string, string> {
+  let parsed: any;
+  try {
+    parsed = JSON.parse(raw);
+  } catch (e) {
+    throw new Error(`sensor config is not valid json: ${e.message}`);
+  }
+  if (typeof parsed !== "object" || parsed === null || Array.isArray(parsed)) {
+    throw new Error("sensor config must be a json object");
+  }
+  const vars: Record<string, string> = {};
+  for (let [field, name] of Object.entries(FIELDS)) {
+    const value = parsed[field];
+    if (value === undefined || value === null) {
+      continue;
+    }
+    const list = field.endsWith("_ids");
+    const values: unknown[] = list && Array.isArray(value) ? value : [value];
+    if (
+      (list && !Array.isArray(value)) ||
+      values.some((v) => typeof v !== "string" && typeof v !== "number")
+    ) {
+      throw new Error(
+        `${field} of the sensor config must be ${
+          list ? "a list of ids" : "a string or a number"
+        }`
+      );
+    }
+    vars[name] = values.join(",");
+  }
+  if (!vars.SENSOR_IDS) {
+    throw new Error("sensor config needs at least one of sensor_ids");
+  }
+  return vars;
+}
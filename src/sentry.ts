@@ -0,0 +1,80 @@
+import { fetchWithTimeout } from "./http";
+import { SourceError } from "./source";
+import { userAgent } from "./version";
+
+export type SentryConfig = {
+  dsn: string; // e.g. https://<key>@o123.ingest.sentry.io/456
+  version: string; // of aqimon, reported as the release
+  timeout: number; // milliseconds
+};
+
+type DSN = { storeURL: string; key: string };
+
+// parseDSN splits a sentry dsn into the project's store endpoint and the
+// public key that authenticates with it.
+export function parseDSN(dsn: string): DSN {
+  let url: URL;
+  try {
+    url = new URL(dsn);
+  } catch (e) {
+    throw new Error("invalid SENTRY_DSN (expected e.g. https://key@host/1)");
+  }
+  const project = url.pathname.split("/").pop();
+  if (!url.username || !project) {
+    throw new Error("invalid SENTRY_DSN (expected e.g. https://key@host/1)");
+  }
+  const path = url.pathname.slice(0, url.pathname.lastIndexOf("/"));
+  return {
+    storeURL: `${url.protocol}//${url.host}${path}/api/${project}/store/`,
+    key: url.username,
+  };
+}
+
+// captureError sends an error to sentry as an event, tagged with tags (e.g.
+// the location and sensor it happened with). the error's kind, when it is a
+// SourceError, is its type, so that e.g. stale data is grouped apart from
+// the upstream failing.
+export async function captureError(
+  config: SentryConfig,
+  error: Error,
+  tags: Record<string, string | undefined>
+): Promise<void> {
+  const { storeURL, key } = parseDSN(config.dsn);
+  const event = {
+    event_id: crypto.randomUUID().replace(/-/g, ""),
+    timestamp: Date.now() / 1000,
+    platform: "javascript",
+    level: "error",
+    logger: "aqimon",
+    release: `aqimon@${config.version}`,
+    tags: Object.fromEntries(
+      Object.entries(tags).filter(([, v]) => v !== undefined)
+    ),
+    exception: {
+      values: [
+        {
+          type: error instanceof SourceError ? error.kind : error.name,
+          value: error.message,
+        },
+      ],
+    },
+  };
+  const response = await fetchWithTimeout(
+    storeURL,
+    {
+      method: "POST",
+      headers: {
+        "user-agent": userAgent(),
+        "content-type": "application/json",
+        "x-sentry-auth": `Sentry sentry_version=7, sentry_client=aqimon/${config.version}, sentry_key=${key}`,
+      },
+      body: JSON.stringify(event),
+    },
+    config.timeout
+  );
+  if (!response.ok) {
+    throw new Error(
+      `non-ok status returned from sentry (${response.status}): ${await response.text()}`
+    );
+  }
+}
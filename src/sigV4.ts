@@ -0,0 +1,79 @@
+import { hmacSHA256, sha256, toHex } from "./crypto";
+
+export type AWSCredentials = {
+  accessKeyID: string;
+  secretAccessKey: string;
+  sessionToken?: string;
+};
+
+export type AWSRequest = {
+  method: string;
+  url: string;
+  headers: Record<string, string>;
+  body: string;
+};
+
+// signRequest returns the headers needed, on top of the request's own, to
+// sign it with AWS Signature Version 4.
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+export async function signRequest(
+  request: AWSRequest,
+  credentials: AWSCredentials,
+  region: string,
+  service: string,
+  now: Date
+): Promise<Record<string, string>> {
+  const url = new URL(request.url);
+  const amzDate = now.toISOString().replace(/[-:]|\.\d+/g, "");
+  const date = amzDate.slice(0, 8);
+  const extra: Record<string, string> = { "x-amz-date": amzDate };
+  if (credentials.sessionToken) {
+    extra["x-amz-security-token"] = credentials.sessionToken;
+  }
+  const headers: Record<string, string> = { host: url.host };
+  for (let [name, value] of Object.entries({ ...request.headers, ...extra })) {
+    headers[name.toLowerCase()] = value.trim().replace(/\s+/g, " ");
+  }
+  const signedHeaders = Object.keys(headers).sort();
+  const query = [...url.searchParams.entries()]
+    .map(([k, v]) => `${encode(k)}=${encode(v)}`)
+    .sort()
+    .join("&");
+  const canonicalRequest = [
+    request.method,
+    url.pathname,
+    query,
+    ...signedHeaders.map((name) => `${name}:${headers[name]}`),
+    "",
+    signedHeaders.join(";"),
+    toHex(await sha256(request.body)),
+  ].join("\n");
+  const scope = `${date}/${region}/${service}/aws4_request`;
+  const stringToSign = [
+    "AWS4-HMAC-SHA256",
+    amzDate,
+    scope,
+    toHex(await sha256(canonicalRequest)),
+  ].join("\n");
+  let key = await hmacSHA256(`AWS4${credentials.secretAccessKey}`, date);
+  for (let part of [region, service, "aws4_request"]) {
+    key = await hmacSHA256(key, part);
+  }
+  const signature = toHex(await hmacSHA256(key, stringToSign));
+  return {
+    ...extra,
+    authorization: `AWS4-HMAC-SHA256 Credential=${
+      credentials.accessKeyID
+    }/${scope}, SignedHeaders=${signedHeaders.join(
+      ";"
+    )}, Signature=${signature}`,
+  };
+}
+
+// encode is the uri encoding SigV4 expects (RFC 3986).
+function encode(s: string): string {
+  return encodeURIComponent(s).replace(
+    /[!'()*]/g,
+    (c) => `%${c.charCodeAt(0).toString(16).toUpperCase()}`
+  );
+}
@@ -0,0 +1,133 @@
+import { hmacSHA256, safeEqual, toHex } from "./crypto";
+import {
+  AirQualityEvent,
+  composeMessage,
+  Notification,
+  Notifier,
+} from "./notifier";
+import { userAgent } from "./version";
+
+export type SlackConfig = {
+  webhookURL: string; // an incoming webhook of the slack app
+  // set when the app has interactivity turned on (pointing at
+  // /slack/interactions), which adds an acknowledge button to reminders
+  interactive: boolean;
+};
+
+// events sent while the air is bad, which reminders follow up on
+const ACKNOWLEDGEABLE: AirQualityEvent[] = [
+  "air_quality_bad",
+  "air_quality_worse",
+  "air_quality_better",
+  "air_quality_still_bad",
+];
+
+export const ACKNOWLEDGE_ACTION = "acknowledge";
+
+export class SlackNotifier implements Notifier {
+  constructor(private config: SlackConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    const text = composeMessage(n);
+    const blocks: unknown[] = [
+      { type: "section", text: { type: "plain_text", text, emoji: true } },
+    ];
+    if (
+      this.config.interactive &&
+      n.episode !== undefined &&
+      !n.test &&
+      ACKNOWLEDGEABLE.includes(n.event)
+    ) {
+      blocks.push({
+        type: "actions",
+        elements: [
+          {
+            type: "button",
+            action_id: ACKNOWLEDGE_ACTION,
+            text: { type: "plain_text", text: "Acknowledge" },
+            value: acknowledgeValue(n.location, n.episode),
+          },
+        ],
+      });
+    }
+    let response = await fetch(this.config.webhookURL, {
+      method: "POST",
+      headers: {
+        "user-agent": userAgent(),
+        "content-type": "application/json",
+      },
+      body: JSON.stringify({ text, blocks }),
+    });
+    if (!response.ok) {
+      throw new Error(
+        `non-ok status returned from slack (${response.status}): ${await response.text()}`
+      );
+    }
+  }
+}
+
+// the button's value says which episode is acknowledged, so that pressing it
+// on an old message doesn't silence a new one
+function acknowledgeValue(location: string | undefined, episode: number) {
+  return JSON.stringify({ location: location || null, episode });
+}
+
+export type Acknowledgement = {
+  location?: string;
+  episode: number; // unix epoch (milliseconds) the bad air started
+  user: string;
+  responseURL?: string;
+};
+
+// requests older than this are refused, so that they can't be replayed
+const MAX_REQUEST_AGE = 60 * 5; // seconds
+
+// verifySlackRequest checks the signature slack puts on interaction requests
+// (https://api.slack.com/authentication/verifying-requests-from-slack).
+export async function verifySlackRequest(
+  signingSecret: string,
+  headers: Headers,
+  body: string,
+  now: number
+): Promise<boolean> {
+  const timestamp = headers.get("x-slack-request-timestamp") || "";
+  const signature = headers.get("x-slack-signature") || "";
+  const age = Math.abs(now / 1000 - parseInt(timestamp, 10));
+  if (isNaN(age) || age > MAX_REQUEST_AGE) {
+    return false;
+  }
+  const mac = await hmacSHA256(signingSecret, `v0:${timestamp}:${body}`);
+  return safeEqual(signature, `v0=${toHex(mac)}`);
+}
+
+// parseAcknowledgement picks the acknowledge button press out of an
+// interaction payload, returning null for anything else.
+export function parseAcknowledgement(body: string): Acknowledgement | null {
+  const payload = JSON.parse(
+    new URLSearchParams(body).get("payload") || "{}"
+  ) as SlackInteraction;
+  const action = (payload.actions || []).find(
+    (a) => a.action_id === ACKNOWLEDGE_ACTION
+  );
+  if (payload.type !== "block_actions" || !action?.value) {
+    return null;
+  }
+  const value = JSON.parse(action.value);
+  if (typeof value?.episode !== "number") {
+    return null;
+  }
+  return {
+    location: value.location || undefined,
+    episode: value.episode,
+    user: payload.user?.id || "someone",
+    responseURL: payload.response_url,
+  };
+}
+
+// https://api.slack.com/reference/interaction-payloads/block-actions
+interface SlackInteraction {
+  type?: string;
+  user?: { id?: string };
+  response_url?: string;
+  actions?: { action_id?: string; value?: string }[];
+}
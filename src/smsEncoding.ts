@@ -0,0 +1,74 @@
+// https://en.wikipedia.org/wiki/GSM_03.38, the characters an sms can be sent
+// in (7 bits each) without switching the whole message over to UCS-2
+const GSM_BASIC =
+  "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+  "¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà";
+// ...and the ones that take an escape character (so two) to send
+const GSM_EXTENDED = "\f^{}\\[~]|€";
+
+export type SMSEncoding = "GSM-7" | "UCS-2";
+
+export type SMSLength = {
+  encoding: SMSEncoding;
+  // septets for GSM-7, UTF-16 code units for UCS-2 (emoji take two)
+  units: number;
+  segments: number;
+};
+
+// a message that doesn't fit in one sms is split up, and each part loses some
+// room to the header that puts them back together
+const SINGLE: Record<SMSEncoding, number> = { "GSM-7": 160, "UCS-2": 70 };
+const PART: Record<SMSEncoding, number> = { "GSM-7": 153, "UCS-2": 67 };
+
+// "…" isn't in GSM-7, so truncated GSM-7 messages end with "..." instead
+const ELLIPSIS: Record<SMSEncoding, string> = { "GSM-7": "...", "UCS-2": "…" };
+
+function encodingOf(body: string): SMSEncoding {
+  for (let c of body) {
+    if (!GSM_BASIC.includes(c) && !GSM_EXTENDED.includes(c)) {
+      return "UCS-2";
+    }
+  }
+  return "GSM-7";
+}
+
+function unitsOf(c: string, encoding: SMSEncoding): number {
+  if (encoding === "UCS-2") {
+    return c.length;
+  }
+  return GSM_EXTENDED.includes(c) ? 2 : 1;
+}
+
+// smsLength is how body would be encoded and how many segments (each billed
+// as its own sms) it takes.
+export function smsLength(body: string): SMSLength {
+  const encoding = encodingOf(body);
+  let units = 0;
+  for (let c of body) {
+    units += unitsOf(c, encoding);
+  }
+  const segments =
+    units <= SINGLE[encoding] ? 1 : Math.ceil(units / PART[encoding]);
+  return { encoding, units, segments };
+}
+
+// truncateSMS shortens body (ending it with an ellipsis) to fit in segments
+// sms, or returns it as is if it already does.
+export function truncateSMS(body: string, segments: number): string {
+  const { encoding, units } = smsLength(body);
+  const room = segments <= 1 ? SINGLE[encoding] : segments * PART[encoding];
+  if (units <= room) {
+    return body;
+  }
+  const ellipsis = ELLIPSIS[encoding];
+  let left = room - ellipsis.length;
+  let kept = "";
+  for (let c of body) {
+    left -= unitsOf(c, encoding);
+    if (left < 0) {
+      break;
+    }
+    kept += c;
+  }
+  return kept.trimEnd() + ellipsis;
+}
@@ -0,0 +1,79 @@
+import {
+  composeMessage,
+  noticeOf,
+  Notification,
+  notificationTitle,
+  Notifier,
+} from "./notifier";
+import { AWSCredentials, signRequest } from "./sigV4";
+import { userAgent } from "./version";
+
+export type SNSConfig = {
+  topicARN: string;
+  region?: string; // defaults to the topic's region
+  credentials: AWSCredentials;
+};
+
+export class SNSNotifier implements Notifier {
+  private region: string;
+
+  constructor(private config: SNSConfig) {
+    // arn:aws:sns:<region>:<account id>:<topic name>
+    const arn = config.topicARN.split(":");
+    if (arn.length !== 6 || arn[0] !== "arn" || arn[2] !== "sns") {
+      throw new Error(`invalid SNS_TOPIC_ARN "${config.topicARN}"`);
+    }
+    this.region = config.region || arn[3];
+  }
+
+  async notify(n: Notification): Promise<void> {
+    const url = `https://sns.${this.region}.amazonaws.com/`;
+    const params = new URLSearchParams({
+      Action: "Publish",
+      Version: "2010-03-31",
+      TopicArn: this.config.topicARN,
+      Subject: notificationTitle(n),
+      Message: composeMessage(n),
+      // lets subscriptions filter on the event
+      "MessageAttributes.entry.1.Name": "event",
+      "MessageAttributes.entry.1.Value.DataType": "String",
+      "MessageAttributes.entry.1.Value.StringValue": n.event,
+    });
+    // ...and on notices about the monitor itself, which aren't about the air
+    const notice = noticeOf(n);
+    if (notice) {
+      params.set("MessageAttributes.entry.2.Name", "notice");
+      params.set("MessageAttributes.entry.2.Value.DataType", "String");
+      params.set("MessageAttributes.entry.2.Value.StringValue", notice);
+    }
+    const body = params.toString();
+    const headers = {
+      "content-type": "application/x-www-form-urlencoded; charset=utf-8",
+    };
+    const signed = await signRequest(
+      { method: "POST", url, headers, body },
+      this.config.credentials,
+      this.region,
+      "sns",
+      new Date()
+    );
+    let response = await fetch(url, {
+      method: "POST",
+      headers: {
+        "user-agent": userAgent(),
+        ...headers,
+        ...signed,
+      },
+      body,
+    });
+    if (!response.ok) {
+      const text = await response.text();
+      const message = /<Message>([^<]*)<\/Message>/.exec(text);
+      throw new Error(
+        `non-ok status returned from sns (${response.status}): ${
+          message ? message[1] : response.statusText
+        }`
+      );
+    }
+  }
+}
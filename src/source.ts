@@ -0,0 +1,88 @@
+import { SensorResults } from "./purpleAir";
+
+export interface SensorSource {
+  readings(): Promise<SensorResults>;
+}
+
+export type SourceErrorKind =
+  | "stale_data"
+  | "no_results"
+  | "upstream_status"
+  | "upstream_not_json"
+  | "upstream_schema";
+
+// SourceError is a reading that could not be taken for a reason callers may
+// want to treat differently from the rest (which are plain errors), told
+// apart by instanceof or kind.
+export abstract class SourceError extends Error {
+  abstract readonly kind: SourceErrorKind;
+}
+
+// StaleDataError means the reading is too old to use, usually because the
+// sensor is offline. the upstream api itself is working.
+export class StaleDataError extends SourceError {
+  readonly kind = "stale_data";
+}
+
+// NoResultsError means the upstream answered, but with nothing to read.
+export class NoResultsError extends SourceError {
+  readonly kind = "no_results";
+}
+
+// UpstreamStatusError means the upstream api answered with a non-ok status.
+export class UpstreamStatusError extends SourceError {
+  readonly kind = "upstream_status";
+
+  constructor(message: string, readonly status: number) {
+    super(message);
+  }
+}
+
+// UpstreamNotJSONError means the upstream api answered ok, but with something
+// other than json (usually an html error page, when it is overloaded).
+export class UpstreamNotJSONError extends SourceError {
+  readonly kind = "upstream_not_json";
+}
+
+// UpstreamSchemaError means the upstream api answered with json, but without
+// the fields aqimon reads from it, which likely means the api has changed (and
+// aqimon needs updating) rather than that it is having a bad moment.
+export class UpstreamSchemaError extends SourceError {
+  readonly kind = "upstream_schema";
+}
+
+// combineErrors wraps the errors from several attempts (e.g. each of the
+// backup sensors) under message, keeping their kind if they all share one.
+export function combineErrors(message: string, errors: Error[]): Error {
+  const kinds = new Set(
+    errors.map((e) => (e instanceof SourceError ? e.kind : undefined))
+  );
+  const first = errors[0];
+  if (kinds.size !== 1 || !(first instanceof SourceError)) {
+    return new Error(message);
+  }
+  if (first instanceof UpstreamStatusError) {
+    return new UpstreamStatusError(message, first.status);
+  }
+  if (first instanceof UpstreamNotJSONError) {
+    return new UpstreamNotJSONError(message);
+  }
+  if (first instanceof UpstreamSchemaError) {
+    return new UpstreamSchemaError(message);
+  }
+  return first instanceof StaleDataError
+    ? new StaleDataError(message)
+    : new NoResultsError(message);
+}
+
+// checkReadings throws if either of the readings could not be converted to
+// the index (e.g. negative humidity corrected readings, or PM2.5 off the
+// chart), so that it is treated like any other failed fetch.
+export function checkReadings(results: SensorResults): SensorResults {
+  if (isNaN(results.realtime) || isNaN(results.tenMinuteAvg)) {
+    throw new Error(
+      `sensor readings could not be converted to aqi (realtime: ${results.realtime}, tenMinuteAvg: ${results.tenMinuteAvg})`
+    );
+  }
+  return results;
+}
@@ -0,0 +1,90 @@
+import { BreakerState } from "./breaker";
+import { logError } from "./newRelic";
+import { AirQualityEvent, Notification } from "./notifier";
+import { SensorResults } from "./purpleAir";
+import { SourceErrorKind } from "./source";
+
+const STATE_KEY = "state";
+
+export type AirQualityZone = "good" | "bad";
+
+export type State = {
+  lastReadings?: SensorResults;
+  lastFetch?: number; // unix epoch (milliseconds)
+  // kind is set for the errors a source tells apart (e.g. stale_data)
+  lastError?: { message: string; at: number; kind?: SourceErrorKind };
+  zone?: AirQualityZone;
+  // unix epoch (milliseconds) of the last notification sent for each event
+  lastNotified?: Partial<Record<AirQualityEvent, number>>;
+  // the most recent notification held back by quiet hours
+  deferred?: Notification;
+  // reminders sent so far while the air has been bad, and when (unix epoch,
+  // milliseconds) the last notification about it went out
+  escalation?: { step: number; at: number };
+  // since when (unix epoch, milliseconds) the air has been bad, and which of
+  // those episodes (by the same timestamp) was acknowledged, ending reminders
+  badSince?: number;
+  acknowledged?: number;
+  breaker?: BreakerState;
+  // since when (unix epoch, milliseconds) readings have come from a backup
+  // sensor, and whether that has been alerted on yet
+  backup?: { since: number; alerted?: boolean };
+  // how many checks in a row the sensor has reported the very same realtime
+  // PM2.5 (or index value, when the source has no PM2.5)
+  flatline?: {
+    sensorID?: string;
+    value: number;
+    count: number;
+    alerted?: boolean;
+  };
+  // readings taken by the build running now, which doesn't notify until it
+  // has WARMUP_CHECKS of them
+  warmup?: { build: string; checks: number };
+};
+
+// locationKey gives each named location its own copy of a kv key, leaving
+// the default location on the key it has always used.
+export function locationKey(key: string, location?: string): string {
+  return location ? `${key}:${location}` : key;
+}
+
+// loadState returns null when there is nothing usable stored, which is
+// treated the same as the monitor having just started.
+export async function loadState(
+  kv: KVNamespace,
+  location?: string
+): Promise<State | null> {
+  const raw = await kv.get(locationKey(STATE_KEY, location));
+  if (raw === null) {
+    return null;
+  }
+  try {
+    const state = JSON.parse(raw) as State;
+    if (
+      state.lastReadings &&
+      (typeof state.lastReadings.realtime !== "number" ||
+        typeof state.lastReadings.tenMinuteAvg !== "number")
+    ) {
+      throw new Error("invalid last readings");
+    }
+    return state;
+  } catch (e) {
+    logError("stored state is corrupt, ignoring it", {
+      error: e.message,
+    });
+    return null;
+  }
+}
+
+// saveState stores state for ttl milliseconds, which has to outlast the time
+// until the next check for it to be compared against.
+export function saveState(
+  kv: KVNamespace,
+  state: State,
+  ttl: number,
+  location?: string
+): Promise<void> {
+  return kv.put(locationKey(STATE_KEY, location), JSON.stringify(state), {
+    expirationTtl: Math.ceil(ttl / 1000),
+  });
+}
@@ -0,0 +1,65 @@
+import { composeMessage, Notification, Notifier } from "./notifier";
+import { userAgent } from "./version";
+
+export type TelegramConfig = {
+  botToken: string;
+  chatID: string;
+};
+
+export class TelegramNotifier implements Notifier {
+  private chatID: number | string;
+
+  constructor(private config: TelegramConfig) {
+    // chat ids are either numeric, or the @username of a public channel
+    if (/^-?\d+$/.test(config.chatID)) {
+      this.chatID = parseInt(config.chatID, 10);
+    } else if (/^@\w+$/.test(config.chatID)) {
+      this.chatID = config.chatID;
+    } else {
+      throw new Error(
+        `invalid TELEGRAM_CHAT_ID "${config.chatID}" (expected a numeric id or @channelname)`
+      );
+    }
+  }
+
+  async notify(n: Notification): Promise<void> {
+    const [headline, ...rest] = composeMessage(n).split("\n");
+    const text = [`*${escapeMarkdown(headline)}*`]
+      .concat(rest.map(escapeMarkdown))
+      .join("\n");
+    let response = await fetch(
+      `https://api.telegram.org/bot${this.config.botToken}/sendMessage`,
+      {
+        method: "POST",
+        headers: {
+          "user-agent": userAgent(),
+          "content-type": "application/json",
+          accept: "application/json",
+        },
+        body: JSON.stringify({
+          chat_id: this.chatID,
+          text,
+          parse_mode: "MarkdownV2",
+        }),
+      }
+    );
+    if (!response.ok) {
+      const body = (await response.json().catch(() => ({}))) as TelegramResponse;
+      throw new Error(
+        `non-ok status returned from telegram (${response.status}): ${
+          body.description || response.statusText
+        }`
+      );
+    }
+  }
+}
+
+// https://core.telegram.org/bots/api#markdownv2-style
+function escapeMarkdown(s: string): string {
+  return s.replace(/[_*\[\]()~`>#+\-=|{}.!\\]/g, "\\$&");
+}
+
+interface TelegramResponse {
+  ok: boolean;
+  description?: string;
+}
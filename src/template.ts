@@ -0,0 +1,52 @@
+import { roundAQI } from "./aqi";
+import { Notification } from "./notifier";
+
+type Field = (n: Notification, timeZone: string) => string;
+
+const FIELDS: Record<string, Field> = {
+  Event: (n) => n.event,
+  RT: (n) => String(roundAQI(n.readings.realtime, n.precision || 0)),
+  TenMAvg: (n) =>
+    String(roundAQI(n.readings.tenMinuteAvg, n.precision || 0)),
+  Category: (n) => n.category,
+  PreviousCategory: (n) => n.previousCategory,
+  SensorID: (n) => n.readings.sensorID || "",
+  Time: (n, timeZone) => new Date().toLocaleString("en-US", { timeZone }),
+  Trend: (n) => (n.trend ? n.trend.label : ""),
+  Delta: (n) => (n.trend ? String(n.trend.delta) : ""),
+  ETA: (n) => (n.trend?.eta ? String(n.trend.eta.minutes) : ""),
+  NextCategory: (n) => (n.trend?.eta ? n.trend.eta.category : ""),
+  Location: (n) => n.location || "",
+  Index: (n) => n.index || "AQI",
+};
+
+const ACTION = /\{\{\s*\.(\w+)\s*\}\}/g;
+
+// MessageTemplate is a tiny subset of go's text/template: every {{.Field}} is
+// replaced with that field of the notification, and that's it. templates are
+// checked up front so that a typo fails the check instead of a notification.
+export class MessageTemplate {
+  constructor(private source: string, private timeZone: string) {
+    for (let match of source.matchAll(ACTION)) {
+      if (!FIELDS.hasOwnProperty(match[1])) {
+        throw new Error(
+          `unknown field .${match[1]} (expected one of: ${Object.keys(
+            FIELDS
+          ).join(", ")})`
+        );
+      }
+    }
+    const rest = source.replace(ACTION, "");
+    if (rest.includes("{{") || rest.includes("}}")) {
+      throw new Error("malformed action, only {{.Field}} is supported");
+    }
+    // throws a RangeError for unknown time zones
+    new Intl.DateTimeFormat("en-US", { timeZone });
+  }
+
+  render(n: Notification): string {
+    return this.source.replace(ACTION, (_, field: string) =>
+      FIELDS[field](n, this.timeZone)
+    );
+  }
+}
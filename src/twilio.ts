@@ -0,0 +1,249 @@
+import { Buffer } from "buffer/";
+import { hmacSHA1, safeEqual } from "./crypto";
+import { logError, logInfo, logWarn } from "./newRelic";
+import {
+  AirQualityEvent,
+  composeMessage,
+  noticeOf,
+  Notification,
+  Notifier,
+} from "./notifier";
+import { smsLength, truncateSMS } from "./smsEncoding";
+import { userAgent } from "./version";
+
+export type SMSConfig = {
+  accountSID: string;
+  authToken: string;
+  // messages are sent from the messaging service if one is set, otherwise
+  // from the from number
+  from?: string;
+  messagingServiceSID?: string;
+  recipients: Recipient[];
+  whatsapp: boolean; // send WhatsApp messages instead of SMS
+  // where twilio reports back whether each message was delivered (the
+  // worker's /twilio/status)
+  statusCallback?: string;
+  // messages taking more sms segments than this are warned about, or with
+  // truncate, cut short to fit. 0 doesn't limit them
+  maxSegments: number;
+  truncate: boolean;
+};
+
+export type Recipient = {
+  phoneNumber: string;
+  events: AirQualityEvent[] | "all"; // what they are sent messages about
+};
+
+// the names events are subscribed to by, in SMS_RECIPIENTS
+const EVENT_NAMES: Record<string, AirQualityEvent> = {
+  bad: "air_quality_bad",
+  good: "air_quality_good",
+  worse: "air_quality_worse",
+  better: "air_quality_better",
+  still_bad: "air_quality_still_bad",
+};
+
+// parseRecipients reads SMS_RECIPIENTS entries, which are a phone number
+// optionally followed by the events it should get, e.g. "+14155551234:bad"
+// or "+14155551234:bad+worse". without any, it gets everything.
+export function parseRecipients(entries: string[]): Recipient[] {
+  return entries.map((entry) => {
+    const [phoneNumber, subscription] = entry.split(":", 2);
+    if (subscription === undefined || subscription === "all") {
+      return { phoneNumber, events: "all" };
+    }
+    const events = subscription.split("+").map((name) => {
+      if (!EVENT_NAMES.hasOwnProperty(name)) {
+        throw new Error(
+          `unknown event "${name}" for ${phoneNumber} (expected all or any of: ${Object.keys(
+            EVENT_NAMES
+          ).join(", ")})`
+        );
+      }
+      return EVENT_NAMES[name];
+    });
+    return { phoneNumber, events };
+  });
+}
+
+// https://www.twilio.com/docs/api/errors/63007
+const WHATSAPP_SENDER_NOT_FOUND = 63007;
+
+const E164 = /^\+[1-9]\d{1,14}$/;
+
+// validateE164 returns an error listing every number that is not in E.164
+// format (e.g. +14155551234), or null if they are all fine.
+export function validateE164(numbers: string[]): Error | null {
+  const invalid = numbers.filter((n) => !E164.test(n));
+  if (invalid.length === 0) {
+    return null;
+  }
+  return new Error(
+    `phone numbers must be in E.164 format (e.g. +14155551234): ${invalid
+      .map((n) => `"${n}"`)
+      .join(", ")}`
+  );
+}
+
+export class SMSNotifier implements Notifier {
+  constructor(private config: SMSConfig) {
+    if (!config.from && !config.messagingServiceSID) {
+      throw new Error(
+        "either TWILIO_FROM or TWILIO_MESSAGING_SERVICE_SID is required"
+      );
+    }
+    if (
+      config.messagingServiceSID &&
+      !/^MG[0-9a-f]{32}$/i.test(config.messagingServiceSID)
+    ) {
+      throw new Error(
+        `invalid TWILIO_MESSAGING_SERVICE_SID "${config.messagingServiceSID}" (expected MG followed by 32 hex digits)`
+      );
+    }
+    const numbers = config.recipients.map((r) => r.phoneNumber);
+    const err = validateE164(config.from ? [config.from, ...numbers] : numbers);
+    if (err) {
+      throw err;
+    }
+  }
+
+  async notify(n: Notification): Promise<void> {
+    let allURLParams = new URLSearchParams();
+    allURLParams.set("Body", this.fit(composeMessage(n)));
+    if (this.config.messagingServiceSID) {
+      allURLParams.set("MessagingServiceSid", this.config.messagingServiceSID);
+    } else {
+      allURLParams.set("From", this.address(this.config.from || ""));
+    }
+    if (this.config.statusCallback) {
+      allURLParams.set("StatusCallback", this.config.statusCallback);
+    }
+    const delivered: { to: string; sid?: string }[] = [];
+    const errors: string[] = [];
+    // tests go to everyone, they are about checking that messages get through.
+    // notices only go to those getting everything, the rest subscribed to
+    // changes in the air
+    const recipients = this.config.recipients.filter(
+      (r) =>
+        n.test ||
+        r.events === "all" ||
+        (!noticeOf(n) && r.events.includes(n.event))
+    );
+    if (recipients.length === 0) {
+      logInfo("no sms recipients subscribed to this event", {
+        event: n.event,
+      });
+      return;
+    }
+    for (let { phoneNumber } of recipients) {
+      let urlParams = new URLSearchParams(allURLParams);
+      urlParams.set("To", this.address(phoneNumber));
+      try {
+        const sid = await this.send(urlParams);
+        delivered.push({ to: phoneNumber, sid });
+      } catch (e) {
+        errors.push(`${phoneNumber}: ${e.message}`);
+      }
+    }
+    logInfo("sent sms notifications", { delivered });
+    if (errors.length > 0) {
+      throw new Error(`failed to send sms to ${errors.join(", ")}`);
+    }
+  }
+
+  // send returns the sid of the message, which the status callbacks about it
+  // refer to.
+  private async send(
+    urlParams: URLSearchParams
+  ): Promise<string | undefined> {
+    let response = await fetch(
+      `https://api.twilio.com/2010-04-01/Accounts/${this.config.accountSID}/Messages.json`,
+      {
+        method: "POST",
+        headers: {
+          "user-agent": userAgent(),
+          "content-type": "application/x-www-form-urlencoded",
+          accept: "application/json",
+          authorization: this.authHeader(),
+        },
+        body: urlParams.toString(),
+      }
+    );
+    if (!response.ok) {
+      const body = await response.text();
+      logError(`non-ok response body`, { body });
+      if (
+        this.config.whatsapp &&
+        errorCode(body) === WHATSAPP_SENDER_NOT_FOUND
+      ) {
+        throw new Error(
+          `${
+            this.config.from || "the messaging service"
+          } is not a WhatsApp enabled sender on this twilio account`
+        );
+      }
+      throw new Error(
+        `non-ok status returned from twilio (${response.statusText})`
+      );
+    }
+    const message = (await response.json().catch(() => ({}))) as {
+      sid?: string;
+    };
+    return message.sid;
+  }
+
+  // fit checks that body stays within maxSegments, which whatsapp messages
+  // (not being split into segments) don't have to.
+  private fit(body: string): string {
+    const length = smsLength(body);
+    if (
+      this.config.whatsapp ||
+      this.config.maxSegments <= 0 ||
+      length.segments <= this.config.maxSegments
+    ) {
+      return body;
+    }
+    logWarn("sms message is longer than SMS_MAX_SEGMENTS", {
+      ...length,
+      max_segments: this.config.maxSegments,
+      truncated: this.config.truncate,
+    });
+    return this.config.truncate
+      ? truncateSMS(body, this.config.maxSegments)
+      : body;
+  }
+
+  private address(phoneNumber: string): string {
+    return this.config.whatsapp ? `whatsapp:${phoneNumber}` : phoneNumber;
+  }
+
+  private authHeader(): string {
+    return `Basic ${Buffer.from(
+      `${this.config.accountSID}:${this.config.authToken}`
+    ).toString("base64")}`;
+  }
+}
+
+function errorCode(body: string): number | undefined {
+  try {
+    return JSON.parse(body).code;
+  } catch (e) {
+    return undefined;
+  }
+}
+
+// verifyTwilioRequest checks the X-Twilio-Signature of a request twilio made
+// to url (exactly as it was given to twilio) with the form params
+// (https://www.twilio.com/docs/usage/security#validating-requests).
+export async function verifyTwilioRequest(
+  authToken: string,
+  url: string,
+  params: URLSearchParams,
+  signature: string
+): Promise<boolean> {
+  const data = [...params.entries()]
+    .sort(([a], [b]) => (a < b ? -1 : a > b ? 1 : 0))
+    .reduce((data, [key, value]) => data + key + value, url);
+  const mac = await hmacSHA1(authToken, data);
+  return safeEqual(signature, Buffer.from(mac).toString("base64"));
+}
@@ -0,0 +1,30 @@
+import { optionalVar } from "./env";
+
+// replaced at build time by esbuild's --define (see the makefile), and left
+// undefined by anything else that bundles the worker
+declare const BUILD_VERSION: string | undefined;
+declare const BUILD_COMMIT: string | undefined;
+declare const BUILD_DATE: string | undefined;
+
+export const buildInfo = {
+  version: typeof BUILD_VERSION !== "undefined" ? BUILD_VERSION : "dev",
+  commit: typeof BUILD_COMMIT !== "undefined" ? BUILD_COMMIT : "unknown",
+  buildDate: typeof BUILD_DATE !== "undefined" ? BUILD_DATE : "unknown",
+};
+
+const PROJECT_URL = "https://github.com/nkcmr/aqimon";
+
+// userAgent is sent with every outgoing request, so that providers can tell
+// who is calling (and get in touch instead of blocking), e.g.
+// "aqimon/v1.2.3 (+https://github.com/nkcmr/aqimon; me@example.com)".
+// USER_AGENT replaces it entirely.
+export function userAgent(): string {
+  const custom = optionalVar("USER_AGENT");
+  if (custom) {
+    return custom;
+  }
+  const contact = optionalVar("CONTACT_EMAIL");
+  return `aqimon/${buildInfo.version} (+${PROJECT_URL}${
+    contact ? `; ${contact}` : ""
+  })`;
+}
@@ -0,0 +1,79 @@
+import { roundAQI } from "./aqi";
+import { hmacSHA256, toHex } from "./crypto";
+import { Notification, Notifier } from "./notifier";
+import { userAgent } from "./version";
+
+export type WebhookConfig = {
+  url: string;
+  secret?: string;
+  // an mtls certificate binding, to present a client certificate with
+  clientCert?: Fetcher;
+};
+
+// WebhookPayload is the body POSTed to WEBHOOK_URL. fields may be added, but
+// existing ones won't be renamed or removed (see the README).
+export type WebhookPayload = {
+  event: string;
+  rt_aqi: number;
+  tenm_aqi: number;
+  category: string;
+  sensor_id: string | null;
+  timestamp: string; // RFC 3339
+  trend: string | null;
+  trend_delta: number | null;
+  eta_category: string | null;
+  eta_minutes: number | null;
+  location: string | null;
+  index: string;
+  test: boolean;
+  startup: boolean;
+  backup: boolean;
+  primary_down: boolean;
+  flatline: boolean;
+};
+
+export class WebhookNotifier implements Notifier {
+  constructor(private config: WebhookConfig) {}
+
+  async notify(n: Notification): Promise<void> {
+    const payload: WebhookPayload = {
+      event: n.event,
+      rt_aqi: roundAQI(n.readings.realtime, n.precision || 0),
+      tenm_aqi: roundAQI(n.readings.tenMinuteAvg, n.precision || 0),
+      category: n.category,
+      sensor_id: n.readings.sensorID || null,
+      timestamp: new Date().toJSON(),
+      trend: n.trend ? n.trend.label : null,
+      trend_delta: n.trend ? n.trend.delta : null,
+      eta_category: n.trend?.eta ? n.trend.eta.category : null,
+      eta_minutes: n.trend?.eta ? n.trend.eta.minutes : null,
+      location: n.location || null,
+      index: n.index || "AQI",
+      test: !!n.test,
+      startup: !!n.startup,
+      backup: !!n.readings.backup,
+      primary_down: !!n.primaryDown,
+      flatline: !!n.flatline,
+    };
+    const body = JSON.stringify(payload);
+    const headers: Record<string, string> = {
+      "user-agent": userAgent(),
+      "content-type": "application/json",
+    };
+    if (this.config.secret) {
+      const mac = await hmacSHA256(this.config.secret, body);
+      headers["x-signature"] = `sha256=${toHex(mac)}`;
+    }
+    const init = { method: "POST", headers, body };
+    // global fetch can't be called as a method of something else, so it is
+    // kept apart from the certificate's
+    let response = this.config.clientCert
+      ? await this.config.clientCert.fetch(this.config.url, init)
+      : await fetch(this.config.url, init);
+    if (!response.ok) {
+      throw new Error(
+        `non-ok status returned from webhook (${response.status}): ${response.statusText}`
+      );
+    }
+  }
+}
@@ -0,0 +1,103 @@
+import assert from "node:assert/strict";
+import { test } from "node:test";
+import {
+  AirQualityIndex,
+  AQHI,
+  AQHICategory,
+  AQICategory,
+  CAQI,
+  categoryFromAQI,
+  CPCB,
+  CPCBCategory,
+  cpcbFromPM,
+  cpcbFromPM10,
+  findCategory,
+  US_AQI,
+} from "../src/aqi";
+
+test("categories include their upper bound", () => {
+  const cases: [number, AQICategory][] = [
+    [0, AQICategory.Good],
+    [50, AQICategory.Good],
+    [51, AQICategory.Moderate],
+    [100, AQICategory.Moderate],
+    [101, AQICategory.UnhealthySensitive],
+    [150, AQICategory.UnhealthySensitive],
+    [151, AQICategory.Unhealthy],
+    [200, AQICategory.Unhealthy],
+    [201, AQICategory.VeryUnhealthy],
+    [300, AQICategory.VeryUnhealthy],
+    [301, AQICategory.Hazardous],
+    [500, AQICategory.Hazardous],
+  ];
+  for (let [aqi, category] of cases) {
+    assert.equal(categoryFromAQI(aqi), category, `AQI ${aqi}`);
+  }
+});
+
+test("categories go by the whole number", () => {
+  assert.equal(categoryFromAQI(50.4), AQICategory.Good);
+  assert.equal(categoryFromAQI(50.5), AQICategory.Moderate);
+});
+
+test("CPCB breakpoints", () => {
+  const cases: [number, number][] = [
+    [0, 0],
+    [30, 50],
+    [30.5, 50 + 50 / 60],
+    [60, 100],
+    [90, 200],
+    [120, 300],
+    [250, 400],
+    [380, 500],
+  ];
+  for (let [pm, aqi] of cases) {
+    assert.ok(Math.abs(cpcbFromPM(pm) - aqi) < 1e-9, `PM2.5 ${pm}`);
+  }
+  assert.equal(cpcbFromPM10(50), 50);
+  assert.equal(cpcbFromPM10(50.5), 50.5);
+  assert.equal(cpcbFromPM10(250), 200);
+  assert.equal(cpcbFromPM10(510), 500);
+});
+
+test("CPCB has no gaps between bands", () => {
+  for (let [fromPM, max] of [
+    [cpcbFromPM, 380],
+    [cpcbFromPM10, 510],
+  ] as const) {
+    let last = fromPM(0);
+    for (let pm = 0.1; pm <= max; pm += 0.1) {
+      const aqi = fromPM(pm);
+      assert.ok(aqi >= last && aqi - last < 1, `PM ${pm}: ${last} -> ${aqi}`);
+      last = aqi;
+    }
+  }
+});
+
+test("the best category of every index is below any threshold", () => {
+  for (let index of [US_AQI, AQHI, CPCB, CAQI]) {
+    const [best, next] = index.categories;
+    assert.ok(index.floor(best) < 0, index.name);
+    assert.ok(index.floor(next) > 0, index.name);
+  }
+  assert.equal(AQHI.floor(AQHICategory.Low), -1);
+});
+
+test("findCategory", () => {
+  const cases: [AirQualityIndex, string, string | undefined][] = [
+    [US_AQI, "unhealthy", AQICategory.Unhealthy],
+    [US_AQI, "Very Unhealthy", AQICategory.VeryUnhealthy],
+    [US_AQI, "very_unhealthy", AQICategory.VeryUnhealthy],
+    [US_AQI, "usg", AQICategory.UnhealthySensitive],
+    [US_AQI, "good", AQICategory.Good],
+    [US_AQI, "bad", undefined],
+    [AQHI, "low", AQHICategory.Low],
+    [AQHI, "high", AQHICategory.High],
+    [AQHI, "high risk", AQHICategory.High],
+    [AQHI, "usg", undefined],
+    [CPCB, "poor", CPCBCategory.Poor],
+  ];
+  for (let [index, name, category] of cases) {
+    assert.equal(findCategory(index, name), category, `${index.name} ${name}`);
+  }
+});
@@ -0,0 +1,106 @@
+import assert from "node:assert/strict";
+import { test } from "node:test";
+import { US_AQI } from "../src/aqi";
+import { evaluate, Settings, Thresholds, zoneOf } from "../src/evaluate";
+import { AirQualityEvent, MultiNotifier, Notifier } from "../src/notifier";
+import { checkReadings, SensorSource } from "../src/source";
+import { AirQualityZone, State } from "../src/state";
+import { FakeNotifier, FakeSource } from "./fakes";
+
+function settings(thresholds: Thresholds): Settings {
+  return {
+    location: {},
+    index: US_AQI,
+    precision: 0,
+    thresholds,
+    decision: "tenm",
+    templates: {},
+    schedule: [],
+    cooldown: 0,
+    quiet: null,
+    noteBackup: false,
+  };
+}
+
+function readings(aqi: number) {
+  return { realtime: aqi, tenMinuteAvg: aqi, sensorID: "1" };
+}
+
+// check takes a reading and notifies about it the way checkAirQuality does,
+// minus the storage
+async function check(
+  source: SensorSource,
+  notifier: Notifier,
+  state: State,
+  settings: Settings,
+  now: number
+): Promise<State> {
+  const results = checkReadings(await source.readings());
+  if (!state.lastReadings) {
+    return { lastReadings: results, zone: zoneOf(results, settings) };
+  }
+  const next = evaluate(
+    { ...state, lastReadings: state.lastReadings },
+    results,
+    now,
+    settings
+  );
+  if (next.notification) {
+    await notifier.notify(next.notification);
+  }
+  return next.state;
+}
+
+test("evaluate", () => {
+  const one = { high: 100, low: 100 };
+  const two = { high: 100, low: 80 }; // hysteresis
+  const cases: [
+    string,
+    Thresholds,
+    AirQualityZone,
+    number,
+    number,
+    AirQualityEvent | null,
+    AirQualityZone
+  ][] = [
+    ["good to bad", one, "good", 50, 120, "air_quality_bad", "bad"],
+    ["bad to good", one, "bad", 120, 90, "air_quality_good", "good"],
+    ["stays good", one, "good", 40, 60, null, "good"],
+    ["stays bad", one, "bad", 120, 130, null, "bad"],
+    ["at the threshold", one, "good", 90, 100, null, "good"],
+    ["rounds to it", one, "good", 90, 100.4, null, "good"],
+    ["at high", two, "good", 70, 100, null, "good"],
+    ["past high", two, "good", 70, 101, "air_quality_bad", "bad"],
+    ["above low", two, "bad", 120, 81, "air_quality_better", "bad"],
+    ["at low", two, "bad", 120, 80, "air_quality_good", "good"],
+  ];
+  for (let [name, thresholds, zone, last, aqi, event, nextZone] of cases) {
+    const next = evaluate(
+      { lastReadings: readings(last), zone, lastFetch: 0 },
+      readings(aqi),
+      1000 * 60,
+      settings(thresholds)
+    );
+    assert.equal(next.notification?.event ?? null, event, name);
+    assert.equal(next.state.zone, nextZone, name);
+  }
+});
+
+test("checks notify about each change of zone", async () => {
+  const source = new FakeSource([50, 120, 130, 90, 60]);
+  const fake = new FakeNotifier();
+  const notifier = new MultiNotifier([fake]);
+  let state: State = {};
+  for (let i = 0; i < 5; i++) {
+    state = await check(
+      source,
+      notifier,
+      state,
+      settings({ high: 100, low: 100 }),
+      1000 * 60 * i
+    );
+  }
+  assert.deepEqual(fake.events(), ["air_quality_bad", "air_quality_good"]);
+  assert.deepEqual(fake.sent.map((n) => n.readings.tenMinuteAvg), [120, 90]);
+  assert.equal(state.zone, "good");
+});
@@ -0,0 +1,27 @@
+import { AirQualityEvent, Notification, Notifier } from "../src/notifier";
+import { SensorResults } from "../src/purpleAir";
+import { SensorSource } from "../src/source";
+
+// FakeNotifier keeps every notification it is sent, instead of sending it.
+export class FakeNotifier implements Notifier {
+  sent: Notification[] = [];
+
+  async notify(n: Notification): Promise<void> {
+    this.sent.push(n);
+  }
+
+  events(): AirQualityEvent[] {
+    return this.sent.map((n) => n.event);
+  }
+}
+
+// FakeSource returns each of aqis in turn (as both readings), then keeps
+// returning the last one.
+export class FakeSource implements SensorSource {
+  constructor(private aqis: number[]) {}
+
+  async readings(): Promise<SensorResults> {
+    const aqi = this.aqis.length > 1 ? this.aqis.shift()! : this.aqis[0];
+    return { realtime: aqi, tenMinuteAvg: aqi, sensorID: "1" };
+  }
+}
@@ -0,0 +1,24 @@
+import assert from "node:assert/strict";
+import { test } from "node:test";
+import { parseLocations } from "../src/locations";
+
+test("parseLocations rejects empty sensor ids and notifiers", () => {
+  const cases = [
+    { name: "home", sensor_ids: [""] },
+    { name: "home", sensor_ids: ["1234", " "] },
+    { name: "home", sensor_ids: ["1234", null] },
+    { name: "home", sensor_ids: ["1234"], notifiers: [""] },
+  ];
+  for (let location of cases) {
+    assert.throws(
+      () => parseLocations(JSON.stringify([location])),
+      /must not have empty entries/,
+      JSON.stringify(location)
+    );
+  }
+});
+
+test("parseLocations takes numeric sensor ids", () => {
+  const [home] = parseLocations('[{"name": "home", "sensor_ids": [1234]}]');
+  assert.deepEqual(home.sensorIDs, ["1234"]);
+});
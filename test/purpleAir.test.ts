@@ -0,0 +1,97 @@
+import assert from "node:assert/strict";
+import { afterEach, test } from "node:test";
+import { US_AQI } from "../src/aqi";
+import {
+  AGGREGATES,
+  PurpleAir,
+  PurpleAirOptions,
+  PurpleAirSource,
+  PurpleAirV1,
+} from "../src/purpleAir";
+import { SourceError } from "../src/source";
+
+const realFetch = globalThis.fetch;
+const realNow = Date.now;
+
+afterEach(() => {
+  globalThis.fetch = realFetch;
+  Date.now = realNow;
+});
+
+function options(api: "legacy" | "v1"): PurpleAirOptions {
+  return {
+    api,
+    apiKey: "key",
+    epaCorrection: false,
+    aggregate: AGGREGATES.mean,
+    includePM10: false,
+    retry: { retries: 0, waitMin: 0, waitMax: 0, timeout: 0 },
+    maxDivergence: 0,
+    index: US_AQI,
+    cacheTTL: 0,
+    maxPM: 0,
+  };
+}
+
+test("mean of no channels is null rather than NaN", () => {
+  assert.equal(AGGREGATES.mean([]), null);
+});
+
+test("mean of channels", () => {
+  assert.equal(AGGREGATES.mean([10, 20]), 15);
+  assert.equal(AGGREGATES.mean([7]), 7);
+});
+
+test("median of an odd number of channels is the middle one", () => {
+  assert.equal(AGGREGATES.median([30, 10, 20]), 20);
+  assert.equal(AGGREGATES.median([7]), 7);
+});
+
+test("median of an even number of channels averages the middle two", () => {
+  assert.equal(AGGREGATES.median([40, 10]), 25);
+  assert.equal(AGGREGATES.median([1, 100, 2, 3]), 2.5);
+});
+
+test("median of no channels is null", () => {
+  assert.equal(AGGREGATES.median([]), null);
+});
+
+const NOW = Date.UTC(2026, 0, 1);
+const STALE_AFTER = 1000 * 60 * 10;
+
+const responses: Record<"legacy" | "v1", (lastSeen: number) => object> = {
+  legacy: (lastSeen): PurpleAir => ({
+    results: [{ LastSeen: lastSeen, Stats: JSON.stringify({ v: 5, v1: 5 }) }],
+  }),
+  v1: (lastSeen): PurpleAirV1 => ({
+    sensor: {
+      last_seen: lastSeen,
+      stats: { "pm2.5": 5, "pm2.5_10minute": 5 },
+    },
+  }),
+};
+
+test("readings go stale after 10 minutes", async () => {
+  const cases: [string, number, boolean][] = [
+    ["just under", STALE_AFTER - 1000, false],
+    ["exactly at", STALE_AFTER, false],
+    ["just over", STALE_AFTER + 1000, true],
+  ];
+  Date.now = () => NOW;
+  for (let api of ["legacy", "v1"] as const) {
+    for (let [name, age, stale] of cases) {
+      const lastSeen = (NOW - age) / 1000;
+      globalThis.fetch = async () => Response.json(responses[api](lastSeen));
+      const readings = new PurpleAirSource(["1"], options(api)).readings();
+      if (!stale) {
+        await readings;
+        continue;
+      }
+      await assert.rejects(readings, (e) => {
+        assert.ok(e instanceof SourceError, `${api} ${name}`);
+        assert.equal(e.kind, "stale_data", `${api} ${name}`);
+        return true;
+      });
+    }
+  }
+});
@@ -0,0 +1,103 @@
+import assert from "node:assert/strict";
+import { afterEach, test } from "node:test";
+import { aqiFromPM, US_AQI } from "../src/aqi";
+import { AGGREGATES, PurpleAirSource } from "../src/purpleAir";
+import {
+  checkReadings,
+  combineErrors,
+  NoResultsError,
+  SourceError,
+  StaleDataError,
+  UpstreamNotJSONError,
+  UpstreamSchemaError,
+  UpstreamStatusError,
+} from "../src/source";
+
+const realFetch = globalThis.fetch;
+
+afterEach(() => {
+  globalThis.fetch = realFetch;
+});
+
+test("PM2.5 off the chart is not a number", () => {
+  assert.ok(isNaN(aqiFromPM(1500)));
+  assert.ok(isNaN(aqiFromPM(NaN)));
+});
+
+test("checkReadings rejects readings that are not a number", () => {
+  const cases = [
+    { realtime: NaN, tenMinuteAvg: 50 },
+    { realtime: 50, tenMinuteAvg: NaN },
+    { realtime: NaN, tenMinuteAvg: NaN },
+  ];
+  for (let results of cases) {
+    assert.throws(() => checkReadings(results), /could not be converted/);
+  }
+  const ok = { realtime: 50, tenMinuteAvg: 42 };
+  assert.equal(checkReadings(ok), ok);
+});
+
+test("checkReadings rejects a sensor reading off the chart", async () => {
+  globalThis.fetch = async () =>
+    Response.json({
+      sensor: {
+        last_seen: Date.now() / 1000,
+        stats: { "pm2.5": 1500, "pm2.5_10minute": 1500 },
+      },
+    });
+  const source = new PurpleAirSource(["1"], {
+    api: "v1",
+    apiKey: "key",
+    epaCorrection: false,
+    aggregate: AGGREGATES.mean,
+    includePM10: false,
+    retry: { retries: 0, waitMin: 0, waitMax: 0, timeout: 0 },
+    maxDivergence: 0,
+    index: US_AQI,
+    cacheTTL: 0,
+    maxPM: 0,
+  });
+  const results = await source.readings();
+  assert.ok(isNaN(results.tenMinuteAvg));
+  assert.throws(() => checkReadings(results), /could not be converted/);
+});
+
+test("combineErrors keeps the kind all the errors share", () => {
+  const cases: [Error[], Function][] = [
+    [[new StaleDataError("a"), new StaleDataError("b")], StaleDataError],
+    [[new NoResultsError("a"), new NoResultsError("b")], NoResultsError],
+    [[new UpstreamNotJSONError("a")], UpstreamNotJSONError],
+    [[new UpstreamSchemaError("a")], UpstreamSchemaError],
+  ];
+  for (let [errors, kind] of cases) {
+    const err = combineErrors("all failed", errors);
+    assert.ok(err instanceof kind, `${kind.name}: got ${err.constructor.name}`);
+    assert.ok(err instanceof SourceError);
+    assert.ok(err instanceof Error);
+    assert.equal(err.message, "all failed");
+  }
+});
+
+test("combineErrors keeps the status of upstream status errors", () => {
+  const err = combineErrors("all failed", [
+    new UpstreamStatusError("a", 502),
+    new UpstreamStatusError("b", 503),
+  ]);
+  assert.ok(err instanceof UpstreamStatusError);
+  assert.equal(err.kind, "upstream_status");
+  assert.equal(err.status, 502);
+});
+
+test("combineErrors falls back to a plain error for mixed kinds", () => {
+  const cases: Error[][] = [
+    [new StaleDataError("a"), new NoResultsError("b")],
+    [new StaleDataError("a"), new Error("b")],
+    [new Error("a"), new Error("b")],
+    [],
+  ];
+  for (let errors of cases) {
+    const err = combineErrors("all failed", errors);
+    assert.ok(!(err instanceof SourceError));
+    assert.equal(err.message, "all failed");
+  }
+});
@@ -0,0 +1,28 @@
+import assert from "node:assert/strict";
+import { test } from "node:test";
+import { validateE164 } from "../src/twilio";
+
+test("validateE164", () => {
+  const cases: [string, boolean][] = [
+    ["+14155551234", true],
+    ["+442071838750", true],
+    ["+12", true],
+    ["+123456789012345", true],
+    ["14155551234", false], // no +
+    ["+04155551234", false], // country codes don't start with 0
+    ["+1 415 555 1234", false],
+    ["+1-415-555-1234", false],
+    ["+1234567890123456", false], // more than 15 digits
+    ["+1", false],
+    ["", false],
+  ];
+  for (let [number, valid] of cases) {
+    assert.equal(validateE164([number]) === null, valid, `"${number}"`);
+  }
+});
+
+test("validateE164 lists every invalid number", () => {
+  const err = validateE164(["+14155551234", "415", "+0"]);
+  assert.ok(err);
+  assert.match(err.message, /"415", "\+0"$/);
+});